@@ -50,6 +50,8 @@ func main() {
 			// deprecated. See
 			// https://github.com/kubernetes/cloud-provider/issues/12 for an ongoing
 			// discussion on whether that is to be changed or not.
+			// It only changes the default, the guest clusters with a unique
+			// --cluster-name can set it to false to enforce the cluster ID check.
 			"authentication-skip-lookup":
 			// Prevent reaching out to an authentication-related ConfigMap that
 			// we do not need, and thus do not intend to create RBAC permissions
@@ -100,12 +102,8 @@ func cloudInitializer(config *cloudcontrollerconfig.CompletedConfig) cloudprovid
 		klog.Fatalf("Cloud provider harvester is nil")
 	}
 
-	if !cloud.HasClusterID() {
-		if config.ComponentConfig.KubeCloudShared.AllowUntaggedCloud {
-			klog.Warning("detected a cluster without a ClusterID.  A ClusterID will be required in the future.  Please tag your cluster to avoid any future issues")
-		} else {
-			klog.Fatalf("no ClusterID found.  A ClusterID is required for the cloud harvester to function properly.  This check can be bypassed by setting the allow-untagged-cloud option")
-		}
+	if err := ccm.CheckClusterID(cloud, config.ComponentConfig.KubeCloudShared.AllowUntaggedCloud); err != nil {
+		klog.Fatalf("Cloud provider harvester could not be initialized: %v", err)
 	}
 
 	return cloud
@@ -144,6 +142,31 @@ func registerHarvesterFlags(harv *pflag.FlagSet) {
 			"    This global setting replaces the legacy 'cloudprovider.harvesterhci.io/additional-internal-ips' \n"+
 			"    node annotation.")
 
+	harv.DurationVar(&config.LoadBalancerGCInterval, utils.FlagLoadBalancerGCInterval, utils.DefaultLoadBalancerGCInterval,
+		"The interval to garbage collect the Harvester LoadBalancers whose guest services no longer exist, e.g. \n"+
+			"    the services deleted while the cloud-provider is down, e.g. '10m'. The garbage collection is disabled by default.")
+
+	harv.DurationVar(&config.LoadBalancerGCGracePeriod, utils.FlagLoadBalancerGCGracePeriod, utils.DefaultLoadBalancerGCGracePeriod,
+		"An orphaned Harvester LoadBalancer is only deleted after it has been orphaned for the grace period.")
+
+	harv.BoolVar(&config.LoadBalancerGCDryRun, utils.FlagLoadBalancerGCDryRun, false,
+		"Only log the orphaned Harvester LoadBalancers which would be deleted by the garbage collection.")
+
+	harv.BoolVar(&config.LoadBalancerDirectStatus, utils.FlagLoadBalancerDirectStatus, false,
+		"Return the load balancer status of the services built from the addresses allocated by Harvester, \n"+
+			"    instead of leaving it to kube-vip. Enable it when the cluster runs another VIP agent or none.")
+
+	harv.StringVar(&config.LoadBalancerIPMode, utils.FlagLoadBalancerIPMode, "",
+		"The ipMode (VIP or Proxy) of the load balancer ingresses, it requires --"+utils.FlagLoadBalancerDirectStatus+".")
+
+	harv.StringVar(&config.LoadBalancerHostnameTemplate, utils.FlagLoadBalancerHostnameTemplate, "",
+		"The Go template of the hostname ingress of the load balancers, e.g. \n"+
+			"    '{{.Name}}.{{.Namespace}}.{{.ClusterName}}.example.com'. It requires --"+utils.FlagLoadBalancerDirectStatus+".")
+
+	harv.StringVar(&config.VIPAnnouncer, utils.FlagVIPAnnouncer, utils.VIPAnnouncerKubeVip,
+		"The agent announcing the addresses of the load balancers in the guest cluster: kube-vip, metallb, \n"+
+			"    cilium or none. With none, the load balancer status is returned directly.")
+
 	harv.BoolVar(&config.ShowFullHelpOnError, utils.FlagShowFullHelpOnError, false,
 		"If a configuration error occurs at startup, the full help menu and flag list will be displayed. (default false)")
 }
@@ -0,0 +1,129 @@
+package ccm
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+
+	utils "github.com/harvester/harvester-cloud-provider/pkg/utils"
+)
+
+// Announcer writes the addresses of the load balancer into the service for the agent announcing them in the guest
+// cluster. The addresses of all IP families are separated by comma.
+type Announcer interface {
+	// IPs returns the addresses the service is annotated with.
+	IPs(service *v1.Service) string
+	// SetIPs annotates the service with the addresses and the key sharing them between the primary service and its
+	// secondary services. The annotations and the interface of the other announcers are removed.
+	SetIPs(service *v1.Service, ips, sharingKey string)
+	// IsAnnounced reports whether the service is annotated by SetIPs with the addresses and the sharing key.
+	IsAnnounced(service *v1.Service, ips, sharingKey string) bool
+	// Interface returns the interface the addresses of the service are announced on.
+	Interface(service *v1.Service) string
+	// SetInterface sets the interface to announce the addresses on, an empty interface removes it.
+	SetInterface(service *v1.Service, iface string)
+	// LeasesDHCP reports whether the agent leases the address of the IPAM mode dhcp from the DHCP server.
+	LeasesDHCP() bool
+}
+
+// metadataAnnouncer keeps the addresses in an annotation and the interface in an annotation or a label.
+type metadataAnnouncer struct {
+	ipsKey           string
+	interfaceKey     string
+	interfaceAsLabel bool
+	// sharingKey is the annotation allowing the services with the same value to share the addresses, the agent
+	// refuses to assign an address to more than one service without it
+	sharingKey string
+	leasesDHCP bool
+}
+
+var announcers = map[string]*metadataAnnouncer{
+	utils.VIPAnnouncerKubeVip: {ipsKey: utils.KeyKubevipLoadBalancerIP, interfaceKey: utils.KeyKubevipServiceInterface, leasesDHCP: true},
+	// MetalLB and Cilium select the interface by the pools and policies, which select the services by the label.
+	// They don't lease the address of the IPAM mode dhcp.
+	utils.VIPAnnouncerMetalLB: {ipsKey: utils.KeyMetalLBLoadBalancerIPs, interfaceKey: utils.LabelKeyServiceInterface, interfaceAsLabel: true,
+		sharingKey: utils.KeyMetalLBAllowSharedIP},
+	utils.VIPAnnouncerCilium: {ipsKey: utils.KeyCiliumLoadBalancerIPs, interfaceKey: utils.LabelKeyServiceInterface, interfaceAsLabel: true,
+		sharingKey: utils.KeyCiliumSharingKey},
+	// nothing leases the address of the IPAM mode dhcp without an agent
+	utils.VIPAnnouncerNone: {ipsKey: utils.KeyLoadBalancerIPs, interfaceKey: utils.LabelKeyServiceInterface, interfaceAsLabel: true},
+}
+
+// NewAnnouncer returns the announcer of the name, refer to utils.FlagVIPAnnouncer.
+func NewAnnouncer(name string) (Announcer, error) {
+	a, ok := announcers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown VIP announcer %q", name)
+	}
+	return a, nil
+}
+
+func (a *metadataAnnouncer) LeasesDHCP() bool {
+	return a.leasesDHCP
+}
+
+func (a *metadataAnnouncer) IPs(service *v1.Service) string {
+	return service.Annotations[a.ipsKey]
+}
+
+func (a *metadataAnnouncer) SetIPs(service *v1.Service, ips, sharingKey string) {
+	if service.Annotations == nil {
+		service.Annotations = make(map[string]string)
+	}
+	// the announcer may be switched, the former one must not announce the addresses any longer
+	for _, other := range announcers {
+		if other.ipsKey != a.ipsKey {
+			delete(service.Annotations, other.ipsKey)
+		}
+		if other.sharingKey != a.sharingKey {
+			delete(service.Annotations, other.sharingKey)
+		}
+		if other.interfaceKey != a.interfaceKey {
+			other.SetInterface(service, "")
+		}
+	}
+	service.Annotations[a.ipsKey] = ips
+	if a.sharingKey != "" {
+		service.Annotations[a.sharingKey] = sharingKey
+	}
+}
+
+func (a *metadataAnnouncer) IsAnnounced(service *v1.Service, ips, sharingKey string) bool {
+	if a.IPs(service) != ips || (a.sharingKey != "" && service.Annotations[a.sharingKey] != sharingKey) {
+		return false
+	}
+	for _, other := range announcers {
+		if other.ipsKey != a.ipsKey && service.Annotations[other.ipsKey] != "" {
+			return false
+		}
+		if other.sharingKey != a.sharingKey && service.Annotations[other.sharingKey] != "" {
+			return false
+		}
+		if other.interfaceKey != a.interfaceKey && other.Interface(service) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *metadataAnnouncer) Interface(service *v1.Service) string {
+	if a.interfaceAsLabel {
+		return service.Labels[a.interfaceKey]
+	}
+	return service.Annotations[a.interfaceKey]
+}
+
+func (a *metadataAnnouncer) SetInterface(service *v1.Service, iface string) {
+	metadata := &service.Annotations
+	if a.interfaceAsLabel {
+		metadata = &service.Labels
+	}
+	if iface == "" {
+		delete(*metadata, a.interfaceKey)
+		return
+	}
+	if *metadata == nil {
+		*metadata = make(map[string]string)
+	}
+	(*metadata)[a.interfaceKey] = iface
+}
@@ -0,0 +1,174 @@
+package ccm
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/harvester/harvester/pkg/builder"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	lbv1 "github.com/harvester/harvester-load-balancer/pkg/apis/loadbalancer.harvesterhci.io/v1beta1"
+
+	utils "github.com/harvester/harvester-cloud-provider/pkg/utils"
+)
+
+// getWorkloadType returns the workload type of the load balancer requested by the service.
+func getWorkloadType(service *v1.Service) (lbv1.WorkloadType, error) {
+	value, ok := service.Annotations[utils.KeyWorkloadType]
+	if !ok || value == "" {
+		return lbv1.Cluster, nil
+	}
+
+	switch workloadType := lbv1.WorkloadType(value); workloadType {
+	case lbv1.Cluster, lbv1.VM:
+		return workloadType, nil
+	default:
+		return "", fmt.Errorf("invalid workload type %q of service %s/%s, it must be %s or %s", value, service.Namespace,
+			service.Name, lbv1.Cluster, lbv1.VM)
+	}
+}
+
+// setBackendServers records the VMs of the eligible guest nodes on the load balancer, and selects them as the backend
+// servers of a load balancer of the workload type vm. The nodes are passed by the service controller on every sync, so
+// the load balancer follows the nodes being added, excluded, cordoned or deleted.
+func (l *LoadBalancerManager) setBackendServers(lb *lbv1.LoadBalancer, service *v1.Service, nodes []*v1.Node) error {
+	workloadType, err := getWorkloadType(service)
+	if err != nil {
+		return err
+	}
+	lb.Spec.WorkloadType = workloadType
+
+	selector := labels.Everything()
+	if value := service.Annotations[utils.KeyBackendNodeSelector]; value != "" && workloadType == lbv1.VM {
+		if selector, err = labels.Parse(value); err != nil {
+			return fmt.Errorf("invalid backend node selector %q of service %s/%s: %w", value, service.Namespace, service.Name, err)
+		}
+	}
+
+	localNodes, err := l.localEndpointNodes(service, workloadType)
+	if err != nil {
+		return err
+	}
+
+	vmNames := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		if localNodes != nil && !localNodes.Has(node.Name) {
+			continue
+		}
+		if isBackendNode(node) && selector.Matches(labels.Set(node.Labels)) {
+			vmNames = append(vmNames, l.vmNameOfNode(node))
+		}
+	}
+	// the order of the nodes is not stable, sort them to avoid updating the load balancer on every sync
+	slices.Sort(vmNames)
+	vmNames = slices.Compact(vmNames)
+
+	if lb.Annotations == nil {
+		lb.Annotations = make(map[string]string)
+	}
+	lb.Annotations[utils.AnnotationKeyBackendVMsOnLB] = strings.Join(vmNames, ",")
+	// Harvester rejects a selector with empty values, the load balancer without a selector has no backend servers
+	if workloadType != lbv1.VM || len(vmNames) == 0 {
+		lb.Spec.BackendServerSelector = nil
+		return nil
+	}
+	lb.Spec.BackendServerSelector = map[string][]string{
+		builder.LabelKeyVirtualMachineName: vmNames,
+	}
+
+	return nil
+}
+
+// localEndpointNodes returns the nodes running the ready endpoints of a service with the external traffic policy Local,
+// kube-proxy drops the traffic of the service on the other nodes. It returns nil if the backend servers are not
+// restricted, the backend servers of a load balancer of the workload type cluster are chosen by Harvester.
+func (l *LoadBalancerManager) localEndpointNodes(service *v1.Service, workloadType lbv1.WorkloadType) (sets.Set[string], error) {
+	if workloadType != lbv1.VM || service.Spec.ExternalTrafficPolicy != v1.ServiceExternalTrafficPolicyLocal {
+		return nil, nil
+	}
+
+	selector := labels.SelectorFromSet(labels.Set{discoveryv1.LabelServiceName: service.Name})
+	endpointSlices, err := l.localEndpointSliceCache.List(service.Namespace, selector)
+	if err != nil {
+		return nil, fmt.Errorf("list endpoint slices of service %s/%s failed: %w", service.Namespace, service.Name, err)
+	}
+	nodes := sets.New[string]()
+	for _, slice := range endpointSlices {
+		for _, endpoint := range slice.Endpoints {
+			// an endpoint without the ready condition is ready
+			if endpoint.NodeName == nil || (endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready) {
+				continue
+			}
+			nodes.Insert(*endpoint.NodeName)
+		}
+	}
+
+	return nodes, nil
+}
+
+// checkWorkloadTypeChanged rejects changing the workload type of an existing load balancer, the backend servers of the
+// former workload type would be left behind. The load balancers created before the workload type was configurable are
+// of the workload type cluster.
+func checkWorkloadTypeChanged(service *v1.Service, lb *lbv1.LoadBalancer) error {
+	workloadType, err := getWorkloadType(service)
+	if err != nil {
+		return err
+	}
+	current := lb.Spec.WorkloadType
+	if current == "" {
+		current = lbv1.Cluster
+	}
+	if workloadType != current {
+		return fmt.Errorf("workload type annotation of service %s/%s is not same as the load balancer %s/%s, service: '%s', lb: '%s'",
+			service.Namespace, service.Name, lb.Namespace, lb.Name, workloadType, current)
+	}
+	return nil
+}
+
+// isBackendNode reports whether the guest node can receive the traffic of the load balancers. The service controller
+// may pass the nodes excluded from external load balancers, e.g. when the node set is being synced.
+func isBackendNode(node *v1.Node) bool {
+	if _, ok := node.Labels[v1.LabelNodeExcludeBalancers]; ok {
+		return false
+	}
+	return !node.Spec.Unschedulable && node.DeletionTimestamp == nil
+}
+
+// syncBackendServers shows the backend servers of the Harvester load balancer on the primary service.
+func (l *LoadBalancerManager) syncBackendServers(service *v1.Service, lb *lbv1.LoadBalancer) error {
+	servers := slices.Clone(lb.Status.BackendServers)
+	slices.Sort(servers)
+	value := strings.Join(servers, ",")
+	if service.Annotations[utils.KeyBackendServers] == value {
+		return nil
+	}
+
+	return l.updateService(service, func(svc *v1.Service) {
+		if value == "" {
+			delete(svc.Annotations, utils.KeyBackendServers)
+			return
+		}
+		if svc.Annotations == nil {
+			svc.Annotations = make(map[string]string)
+		}
+		svc.Annotations[utils.KeyBackendServers] = value
+	})
+}
+
+// vmNameResolver resolves the VM of a guest node. It's implemented by instanceManager, so that the backend servers of
+// the load balancers are the same VMs as the instances of the nodes.
+type vmNameResolver interface {
+	vmNameOf(node *v1.Node) string
+}
+
+// vmNameOfNode returns the name of the VM of the guest node, the VM is named after the node if it's not resolved.
+func (l *LoadBalancerManager) vmNameOfNode(node *v1.Node) string {
+	if l.vmNames == nil {
+		return node.Name
+	}
+	return l.vmNames.vmNameOf(node)
+}
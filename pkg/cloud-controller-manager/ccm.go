@@ -9,6 +9,7 @@ import (
 
 	"github.com/sirupsen/logrus"
 
+	ctldiscovery "github.com/harvester/harvester-load-balancer/pkg/generated/controllers/discovery.k8s.io"
 	ctllb "github.com/harvester/harvester-load-balancer/pkg/generated/controllers/loadbalancer.harvesterhci.io"
 	ctlkubevirt "github.com/harvester/harvester/pkg/generated/controllers/kubevirt.io"
 	ctlcore "github.com/rancher/wrangler/v3/pkg/generated/controllers/core"
@@ -16,13 +17,17 @@ import (
 	"github.com/rancher/wrangler/v3/pkg/signals"
 	"github.com/rancher/wrangler/v3/pkg/start"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 	cloudprovider "k8s.io/cloud-provider"
 	"k8s.io/klog/v2"
 	"kubevirt.io/client-go/kubecli"
 
 	cfg "github.com/harvester/harvester-cloud-provider/pkg/config"
 	vmi "github.com/harvester/harvester-cloud-provider/pkg/controller/virtualmachineinstance"
+	utils "github.com/harvester/harvester-cloud-provider/pkg/utils"
 )
 
 const (
@@ -32,12 +37,15 @@ const (
 )
 
 type CloudProvider struct {
-	localCoreFactory *ctlcore.Factory
-	lbFactory        *ctllb.Factory
-	kubevirtFactory  *ctlkubevirt.Factory
+	localCoreFactory      *ctlcore.Factory
+	localDiscoveryFactory *ctldiscovery.Factory
+	lbFactory             *ctllb.Factory
+	kubevirtFactory       *ctlkubevirt.Factory
 
-	loadBalancers cloudprovider.LoadBalancer
+	loadBalancers *LoadBalancerManager
 	instances     cloudprovider.InstancesV2
+	zones         cloudprovider.Zones
+	clusters      *clusterManager
 
 	kubevirtClient kubecli.KubevirtClient
 
@@ -93,11 +101,26 @@ func newCloudProvider(reader io.Reader) (cloudprovider.Interface, error) {
 		return nil, err
 	}
 
+	// the template has been validated when the flags are synced
+	hostnameTemplate, err := utils.ParseLoadBalancerHostnameTemplate(cfg.GetConfig().LoadBalancerHostnameTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	announcer, err := NewAnnouncer(cfg.GetConfig().VIPAnnouncer)
+	if err != nil {
+		return nil, err
+	}
+
 	nodeToVMName := &sync.Map{}
 	cp := &CloudProvider{
-		localCoreFactory: ctlcore.NewFactoryFromConfigOrDie(localCfg),
-		lbFactory:        ctllb.NewFactoryFromConfigOrDie(clientConfig),
-		kubevirtFactory:  kubevirtFactory,
+		localCoreFactory:      ctlcore.NewFactoryFromConfigOrDie(localCfg),
+		localDiscoveryFactory: ctldiscovery.NewFactoryFromConfigOrDie(localCfg),
+		// the load balancers are only watched in the namespace, the IP pools are cluster scoped and got by the client
+		lbFactory: ctllb.NewFactoryFromConfigWithOptionsOrDie(clientConfig, &ctllb.FactoryOptions{
+			Namespace: namespace,
+		}),
+		kubevirtFactory: kubevirtFactory,
 
 		kubevirtClient: kubevirtClient,
 
@@ -107,18 +130,43 @@ func newCloudProvider(reader io.Reader) (cloudprovider.Interface, error) {
 
 		namespace: namespace,
 	}
+	// the indexer must be added before the informer starts
+	vmCache := cp.kubevirtFactory.Kubevirt().V1().VirtualMachine().Cache()
+	vmCache.AddIndexer(indexVMByUID, vmByUID)
+	instances := &instanceManager{
+		vmClient:        cp.kubevirtFactory.Kubevirt().V1().VirtualMachine(),
+		vmCache:         vmCache,
+		vmSynced:        cp.kubevirtFactory.Kubevirt().V1().VirtualMachine().Informer().HasSynced,
+		vmiClient:       cp.kubevirtFactory.Kubevirt().V1().VirtualMachineInstance(),
+		hostClient:      ctlcore.NewFactoryFromConfigOrDie(clientConfig).Core().V1().Node(),
+		localNodeClient: cp.localCoreFactory.Core().V1().Node(),
+		nodeToVMName:    nodeToVMName,
+		namespace:       namespace,
+	}
 	cp.loadBalancers = &LoadBalancerManager{
-		lbClient:       cp.lbFactory.Loadbalancer().V1beta1().LoadBalancer(),
-		localSvcClient: cp.localCoreFactory.Core().V1().Service(),
-		localSvcCache:  cp.localCoreFactory.Core().V1().Service().Cache(),
-		configMapCache: cp.localCoreFactory.Core().V1().ConfigMap().Cache(),
-		namespace:      namespace,
-	}
-	cp.instances = &instanceManager{
-		vmClient:     cp.kubevirtFactory.Kubevirt().V1().VirtualMachine(),
-		vmiClient:    cp.kubevirtFactory.Kubevirt().V1().VirtualMachineInstance(),
-		nodeToVMName: nodeToVMName,
-		namespace:    namespace,
+		lbClient:                cp.lbFactory.Loadbalancer().V1beta1().LoadBalancer(),
+		ipPoolClient:            cp.lbFactory.Loadbalancer().V1beta1().IPPool(),
+		localSvcClient:          cp.localCoreFactory.Core().V1().Service(),
+		localSvcCache:           cp.localCoreFactory.Core().V1().Service().Cache(),
+		configMapCache:          cp.localCoreFactory.Core().V1().ConfigMap().Cache(),
+		localEndpointSliceCache: cp.localDiscoveryFactory.Discovery().V1().EndpointSlice().Cache(),
+		localNodeCache:          cp.localCoreFactory.Core().V1().Node().Cache(),
+		namespace:               namespace,
+		vmNames:                 instances,
+		// the flags are synced into the config before the cloud provider is created
+		directStatus:     cfg.GetConfig().LoadBalancerDirectStatus,
+		ipMode:           corev1.LoadBalancerIPMode(cfg.GetConfig().LoadBalancerIPMode),
+		hostnameTemplate: hostnameTemplate,
+		announcer:        announcer,
+	}
+	// the zones are resolved from the same VMs as the instance metadata
+	cp.instances, cp.zones = instances, instances
+	cp.clusters = &clusterManager{
+		vmClient:        cp.kubevirtFactory.Kubevirt().V1().VirtualMachine(),
+		localNodeClient: cp.localCoreFactory.Core().V1().Node(),
+		namespace:       namespace,
+		clusterName:     cfg.GetConfig().ClusterName,
+		apiServer:       localCfg.Host,
 	}
 
 	logrus.Infof("New CloudProvider Harvester on namespace %s", namespace)
@@ -129,6 +177,30 @@ func newCloudProvider(reader io.Reader) (cloudprovider.Interface, error) {
 func (c *CloudProvider) Initialize(clientBuilder cloudprovider.ControllerClientBuilder, stop <-chan struct{}) {
 	client := clientBuilder.ClientOrDie(ProviderName)
 
+	eventBroadcaster := record.NewBroadcaster(record.WithContext(c.Context))
+	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	c.loadBalancers.recorder = eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: ProviderName + "-cloud-provider"})
+
+	c.loadBalancers.registerLoadBalancerHandler(c.Context, c.lbFactory.Loadbalancer().V1beta1().LoadBalancer())
+	c.loadBalancers.registerEndpointSliceHandler(c.Context, c.localDiscoveryFactory.Discovery().V1().EndpointSlice())
+
+	if interval := cfg.GetConfig().LoadBalancerGCInterval; interval > 0 {
+		gc := &loadBalancerGC{
+			lbClient:       c.loadBalancers.lbClient,
+			localSvcClient: c.loadBalancers.localSvcClient,
+			localSvcCache:  c.loadBalancers.localSvcCache,
+			namespace:      c.namespace,
+			clusterName:    cfg.GetConfig().ClusterName,
+			gracePeriod:    cfg.GetConfig().LoadBalancerGCGracePeriod,
+			dryRun:         cfg.GetConfig().LoadBalancerGCDryRun,
+			serviceSynced:  c.localCoreFactory.Core().V1().Service().Informer().HasSynced,
+		}
+		go gc.run(c.Context, interval)
+		// the retained load balancers are only deleted by the garbage collection, which is disabled without a unique
+		// cluster name
+		c.loadBalancers.retainStableLoadBalancers = gc.clusterName != "" && gc.clusterName != utils.DefaultGuestClusterName
+	}
+
 	if !cfg.GetConfig().DisableVMIController {
 		vmi.Register(
 			c.Context,
@@ -143,7 +215,7 @@ func (c *CloudProvider) Initialize(clientBuilder cloudprovider.ControllerClientB
 	}
 
 	go func() {
-		if err := start.All(c.Context, threadiness, c.kubevirtFactory, c.localCoreFactory, c.lbFactory); err != nil {
+		if err := start.All(c.Context, threadiness, c.kubevirtFactory, c.localCoreFactory, c.localDiscoveryFactory, c.lbFactory); err != nil {
 			klog.Fatalf("error starting controllers: %s", err.Error())
 		}
 		<-stop
@@ -163,13 +235,14 @@ func (c *CloudProvider) InstancesV2() (cloudprovider.InstancesV2, bool) {
 }
 
 func (c *CloudProvider) Zones() (cloudprovider.Zones, bool) {
-	return nil, false
+	return c.zones, true
 }
 
 func (c *CloudProvider) Clusters() (cloudprovider.Clusters, bool) {
-	return nil, false
+	return c.clusters, true
 }
 
+// Routes won't be implemented, refer to the README.
 func (c *CloudProvider) Routes() (cloudprovider.Routes, bool) {
 	return nil, false
 }
@@ -179,5 +252,19 @@ func (c *CloudProvider) ProviderName() string {
 }
 
 func (c *CloudProvider) HasClusterID() bool {
-	return false
+	return c.clusters.hasClusterID()
+}
+
+// CheckClusterID refuses to run the cloud provider without a cluster ID when --allow-untagged-cloud is false, so that a
+// guest cluster can't manage the load balancers of another one by a shared or mistaken cluster name.
+func CheckClusterID(cloud cloudprovider.Interface, allowUntaggedCloud bool) error {
+	if cloud.HasClusterID() {
+		return nil
+	}
+	if !allowUntaggedCloud {
+		return fmt.Errorf("no ClusterID found, the --%s must be unique and label the VMs of the guest cluster by %s. "+
+			"This check can be bypassed by setting the allow-untagged-cloud option", utils.FlagClusterName, utils.LabelKeyGuestClusterNameOnVM)
+	}
+	klog.Warning("detected a cluster without a ClusterID.  A ClusterID will be required in the future.  Please tag your cluster to avoid any future issues")
+	return nil
 }
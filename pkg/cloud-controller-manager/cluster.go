@@ -0,0 +1,116 @@
+package ccm
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	ctlkubevirtv1 "github.com/harvester/harvester/pkg/generated/controllers/kubevirt.io/v1"
+	ctlcorev1 "github.com/rancher/wrangler/v3/pkg/generated/controllers/core/v1"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+
+	utils "github.com/harvester/harvester-cloud-provider/pkg/utils"
+)
+
+// clusterManager identifies the guest cluster by the --cluster-name and the label LabelKeyGuestClusterNameOnVM of its
+// VMs, the guest clusters sharing the Harvester namespace are told apart by the label.
+type clusterManager struct {
+	vmClient ctlkubevirtv1.VirtualMachineClient
+	// localNodeClient lists the nodes of the guest cluster
+	localNodeClient ctlcorev1.NodeClient
+	namespace       string
+	clusterName     string
+	// apiServer is the address of the API server of the guest cluster
+	apiServer string
+}
+
+// ListClusters returns the names of the guest clusters whose VMs are in the Harvester namespace.
+func (c *clusterManager) ListClusters(_ context.Context) ([]string, error) {
+	vms, err := c.vmClient.List(c.namespace, metav1.ListOptions{LabelSelector: utils.LabelKeyGuestClusterNameOnVM})
+	if err != nil {
+		return nil, fmt.Errorf("list VMs of guest clusters in namespace %s failed: %w", c.namespace, err)
+	}
+
+	clusters := make([]string, 0, len(vms.Items))
+	for _, vm := range vms.Items {
+		if name := vm.Labels[utils.LabelKeyGuestClusterNameOnVM]; name != "" {
+			clusters = append(clusters, name)
+		}
+	}
+	slices.Sort(clusters)
+
+	return slices.Compact(clusters), nil
+}
+
+// Master returns the address of the API server of the guest cluster. Only the one of the own cluster is known, the
+// Harvester VMs don't tell the control plane of the other guest clusters.
+func (c *clusterManager) Master(ctx context.Context, clusterName string) (string, error) {
+	if clusterName == c.clusterName && c.apiServer != "" {
+		return c.apiServer, nil
+	}
+
+	clusters, err := c.ListClusters(ctx)
+	if err != nil {
+		return "", err
+	}
+	if !slices.Contains(clusters, clusterName) {
+		return "", fmt.Errorf("guest cluster %q is not found in namespace %s", clusterName, c.namespace)
+	}
+	return "", fmt.Errorf("the API server of guest cluster %q is unknown, only the one of the own cluster %q is known", clusterName, c.clusterName)
+}
+
+// hasClusterID reports whether the guest cluster has a unique identity. The --cluster-name must not be empty or the
+// default shared by all the guest clusters without it, at least one VM must be labelled with it, and none of the VMs
+// of the guest nodes may be labelled with another cluster name.
+func (c *clusterManager) hasClusterID() bool {
+	if c.clusterName == "" || c.clusterName == utils.DefaultGuestClusterName {
+		logrus.Warnf("the guest cluster has no cluster ID as the --%s is empty or default", utils.FlagClusterName)
+		return false
+	}
+
+	// the VMs are indexed by UID to match the provider IDs of the nodes, the VM cache isn't started yet when the cloud
+	// provider is initialized
+	vms, err := c.vmClient.List(c.namespace, metav1.ListOptions{})
+	if err != nil {
+		logrus.Warnf("list VMs in namespace %s failed: %v", c.namespace, err)
+		return false
+	}
+	labelled := false
+	vmsByUID := make(map[string]*kubevirtv1.VirtualMachine, len(vms.Items))
+	for idx := range vms.Items {
+		vm := &vms.Items[idx]
+		vmsByUID[string(vm.UID)] = vm
+		labelled = labelled || vm.Labels[utils.LabelKeyGuestClusterNameOnVM] == c.clusterName
+	}
+	if !labelled {
+		logrus.Warnf("the guest cluster has no cluster ID as no VM in namespace %s is labelled with %s=%s", c.namespace,
+			utils.LabelKeyGuestClusterNameOnVM, c.clusterName)
+		return false
+	}
+
+	nodes, err := c.localNodeClient.List(metav1.ListOptions{})
+	if err != nil {
+		logrus.Warnf("list nodes of guest cluster %s failed: %v", c.clusterName, err)
+		return false
+	}
+	for _, node := range nodes.Items {
+		uid, ok := strings.CutPrefix(node.Spec.ProviderID, ProviderName+"://")
+		if !ok {
+			continue
+		}
+		vm, ok := vmsByUID[uid]
+		if !ok {
+			continue
+		}
+		if name, ok := vm.Labels[utils.LabelKeyGuestClusterNameOnVM]; ok && name != c.clusterName {
+			logrus.Warnf("the guest cluster has no cluster ID as the VM %s/%s of node %s is labelled with cluster %q instead of %q",
+				vm.Namespace, vm.Name, node.Name, name, c.clusterName)
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,107 @@
+package ccm
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	lbv1 "github.com/harvester/harvester-load-balancer/pkg/apis/loadbalancer.harvesterhci.io/v1beta1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// serviceConditionPrefix prefixes the type of the load balancer conditions copied onto the service, e.g. the Ready
+	// condition is copied as HarvesterLoadBalancerReady.
+	serviceConditionPrefix = "HarvesterLoadBalancer"
+
+	eventReasonLoadBalancerNotReady = "HarvesterLoadBalancerNotReady"
+	conditionReasonReady            = "HarvesterLoadBalancerReady"
+)
+
+// conditionReasonRegexp is the format of the reason of metav1.Condition
+var conditionReasonRegexp = regexp.MustCompile(`^[A-Za-z]([A-Za-z0-9_,:]*[A-Za-z0-9_])?$`)
+
+// serviceConditionType returns the type of the service condition copied from the load balancer condition. The
+// conditions of the load balancer of the second IP family contain the family, e.g. HarvesterLoadBalancerIPv6Ready.
+func serviceConditionType(flb familyLoadBalancer, conditionType string) string {
+	if flb.index > 0 {
+		return serviceConditionPrefix + string(flb.family) + conditionType
+	}
+	return serviceConditionPrefix + conditionType
+}
+
+// toServiceCondition converts the load balancer condition to the service condition. The Harvester load balancer
+// controller doesn't always set the reason, which is required by the service condition.
+func toServiceCondition(flb familyLoadBalancer, condition *lbv1.Condition, generation int64) metav1.Condition {
+	status := metav1.ConditionStatus(condition.Status)
+	if status != metav1.ConditionTrue && status != metav1.ConditionFalse {
+		status = metav1.ConditionUnknown
+	}
+
+	reason := condition.Reason
+	if !conditionReasonRegexp.MatchString(reason) {
+		reason = conditionReasonReady
+		if status != metav1.ConditionTrue {
+			reason = eventReasonLoadBalancerNotReady
+		}
+	}
+
+	serviceCondition := metav1.Condition{
+		Type:               serviceConditionType(flb, string(condition.Type)),
+		Status:             status,
+		ObservedGeneration: generation,
+		Reason:             reason,
+		Message:            condition.Message,
+	}
+	// meta.SetStatusCondition sets the current time if it's zero
+	if t, err := time.Parse(time.RFC3339, condition.LastTransitionTime); err == nil {
+		serviceCondition.LastTransitionTime = metav1.NewTime(t)
+	}
+
+	return serviceCondition
+}
+
+// syncServiceConditions copies the conditions of the load balancer onto the status of the service, so that the users
+// without access to the Harvester cluster can see why the load balancer is not ready. A warning event is recorded
+// when a condition turns to not true or its message changes.
+func (l *LoadBalancerManager) syncServiceConditions(service *v1.Service, flb familyLoadBalancer, lb *lbv1.LoadBalancer) error {
+	conditions := make([]metav1.Condition, 0, len(lb.Status.Conditions))
+	for i := range lb.Status.Conditions {
+		condition := toServiceCondition(flb, &lb.Status.Conditions[i], service.Generation)
+		conditions = append(conditions, condition)
+
+		old := meta.FindStatusCondition(service.Status.Conditions, condition.Type)
+		if condition.Status != metav1.ConditionTrue && (old == nil || old.Status != condition.Status || old.Message != condition.Message) {
+			l.recordEvent(service, v1.EventTypeWarning, condition.Reason, "load balancer %s/%s: %s is %s: %s",
+				lb.Namespace, lb.Name, condition.Type, condition.Status, condition.Message)
+		}
+	}
+	if len(conditions) == 0 {
+		return nil
+	}
+
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		latest, err := l.localSvcCache.Get(service.Namespace, service.Name)
+		if err != nil {
+			return err
+		}
+		if latest.UID != service.UID {
+			return nil
+		}
+		serviceCopy := latest.DeepCopy()
+		for _, condition := range conditions {
+			meta.SetStatusCondition(&serviceCopy.Status.Conditions, condition)
+		}
+		if equality.Semantic.DeepEqual(serviceCopy.Status.Conditions, latest.Status.Conditions) {
+			return nil
+		}
+		if _, err := l.localSvcClient.UpdateStatus(serviceCopy); err != nil {
+			return fmt.Errorf("update conditions of service %s/%s failed: %w", service.Namespace, service.Name, err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,100 @@
+package ccm
+
+import (
+	"context"
+	"maps"
+	"slices"
+
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	lbv1 "github.com/harvester/harvester-load-balancer/pkg/apis/loadbalancer.harvesterhci.io/v1beta1"
+	ctldiscoveryv1 "github.com/harvester/harvester-load-balancer/pkg/generated/controllers/discovery.k8s.io/v1"
+
+	cfg "github.com/harvester/harvester-cloud-provider/pkg/config"
+	utils "github.com/harvester/harvester-cloud-provider/pkg/utils"
+)
+
+const (
+	endpointSliceControllerName = "harvester-cloudprovider-endpointslice-backend"
+)
+
+// registerEndpointSliceHandler watches the endpoint slices of the guest cluster services.
+func (l *LoadBalancerManager) registerEndpointSliceHandler(ctx context.Context, endpointSlices ctldiscoveryv1.EndpointSliceController) {
+	logrus.WithField("controller", endpointSliceControllerName).Info("start watching endpoint slices")
+	endpointSlices.OnChange(ctx, endpointSliceControllerName, l.OnEndpointSliceChanged)
+}
+
+// OnEndpointSliceChanged restricts the backend servers of a load balancer of the workload type vm to the nodes running
+// the endpoints of the service with the external traffic policy Local. The service controller only updates the load
+// balancers when the nodes change, the endpoints moving between the nodes are followed here.
+func (l *LoadBalancerManager) OnEndpointSliceChanged(_ string, slice *discoveryv1.EndpointSlice) (*discoveryv1.EndpointSlice, error) {
+	if slice == nil || slice.DeletionTimestamp != nil {
+		return slice, nil
+	}
+	serviceName := slice.Labels[discoveryv1.LabelServiceName]
+	if serviceName == "" {
+		return slice, nil
+	}
+
+	service, err := l.localSvcCache.Get(slice.Namespace, serviceName)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return slice, nil
+		}
+		return slice, err
+	}
+	// the secondary services share the backend servers of the primary service
+	if service.DeletionTimestamp != nil || service.Spec.Type != v1.ServiceTypeLoadBalancer || service.Annotations[utils.KeyPrimaryService] != "" ||
+		service.Spec.ExternalTrafficPolicy != v1.ServiceExternalTrafficPolicyLocal {
+		return slice, nil
+	}
+	if workloadType, err := getWorkloadType(service); err != nil || workloadType != lbv1.VM {
+		return slice, nil
+	}
+
+	nodes, err := l.localNodeCache.List(labels.Everything())
+	if err != nil {
+		return slice, err
+	}
+	for _, flb := range getFamilyLoadBalancers(cfg.GetConfig().ClusterName, service) {
+		if err := l.syncLocalBackendServers(flb.name, service, nodes); err != nil {
+			return slice, err
+		}
+	}
+
+	return slice, nil
+}
+
+// syncLocalBackendServers updates the backend servers of the load balancer if they are changed, the load balancer is
+// created by the service controller.
+func (l *LoadBalancerManager) syncLocalBackendServers(lbName string, service *v1.Service, nodes []*v1.Node) error {
+	lb, err := l.lbClient.Get(l.namespace, lbName, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	lbCopy := lb.DeepCopy()
+	if err := l.setBackendServers(lbCopy, service, nodes); err != nil {
+		return err
+	}
+	if maps.EqualFunc(lb.Spec.BackendServerSelector, lbCopy.Spec.BackendServerSelector, slices.Equal) &&
+		lb.Annotations[utils.AnnotationKeyBackendVMsOnLB] == lbCopy.Annotations[utils.AnnotationKeyBackendVMsOnLB] {
+		return nil
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"loadbalancer": lb.Namespace + "/" + lb.Name,
+		"service":      service.Namespace + "/" + service.Name,
+		"backend vms":  lbCopy.Annotations[utils.AnnotationKeyBackendVMsOnLB],
+	}).Info("update the backend servers to the nodes with local endpoints")
+	_, err = l.lbClient.Update(lbCopy)
+	return err
+}
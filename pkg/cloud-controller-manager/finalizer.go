@@ -0,0 +1,103 @@
+package ccm
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+
+	utils "github.com/harvester/harvester-cloud-provider/pkg/utils"
+)
+
+const (
+	eventReasonDeletionBlocked        = "DeletionBlockedBySecondaryServices"
+	eventReasonPrimaryServiceDeleting = "PrimaryServiceDeleting"
+)
+
+// syncSecondaryServicesFinalizer adds the finalizer to the primary service if it has secondary services, and removes
+// it if it has none, so that the primary service stays in Terminating until the secondary services are deleted or
+// moved to another primary service. The secondary service with the excluded UID is leaving the primary service.
+func (l *LoadBalancerManager) syncSecondaryServicesFinalizer(primary *v1.Service, excluded types.UID) error {
+	secondaries, err := l.listSecondaryServices(primary)
+	if err != nil {
+		return err
+	}
+	secondaries = slices.DeleteFunc(secondaries, func(svc *v1.Service) bool { return svc.UID == excluded })
+
+	hasFinalizer := slices.Contains(primary.Finalizers, utils.FinalizerSecondaryServices)
+	switch {
+	case len(secondaries) > 0 && !hasFinalizer:
+		// no new finalizer can be added to a service being deleted
+		if primary.DeletionTimestamp != nil {
+			return nil
+		}
+		return l.updateFinalizer(primary, func(finalizers []string) []string {
+			return append(finalizers, utils.FinalizerSecondaryServices)
+		})
+	case len(secondaries) == 0 && hasFinalizer:
+		return l.updateFinalizer(primary, func(finalizers []string) []string {
+			return slices.DeleteFunc(finalizers, func(f string) bool { return f == utils.FinalizerSecondaryServices })
+		})
+	}
+
+	return nil
+}
+
+// syncFormerPrimaryService releases the primary service the service used to share the load balancer with, when the
+// service becomes a primary service or moves to another primary service.
+func (l *LoadBalancerManager) syncFormerPrimaryService(service *v1.Service, currentLabelValue string) error {
+	labelValue := service.Labels[utils.KeyPrimaryService]
+	if labelValue == "" || labelValue == currentLabelValue {
+		return nil
+	}
+
+	// the label value is <namespace>.<name>, a namespace can't contain dots
+	namespace, name, ok := strings.Cut(labelValue, ".")
+	if !ok {
+		return nil
+	}
+	former, err := l.localSvcCache.Get(namespace, name)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	if err := l.releasePorts(former, service); err != nil {
+		return err
+	}
+	return l.syncSecondaryServicesFinalizer(former, service.UID)
+}
+
+// recordDeletionBlocked records events on both the primary service being deleted and its secondary services.
+func (l *LoadBalancerManager) recordDeletionBlocked(primary *v1.Service, secondaries []*v1.Service) {
+	names := make([]string, 0, len(secondaries))
+	for _, svc := range secondaries {
+		names = append(names, svc.Namespace+"/"+svc.Name)
+	}
+	slices.Sort(names)
+
+	l.recordEvent(primary, v1.EventTypeWarning, eventReasonDeletionBlocked,
+		"the load balancer is still shared with the secondary services %v, delete them or move them to another primary service", names)
+	for _, svc := range secondaries {
+		l.recordEvent(svc, v1.EventTypeWarning, eventReasonPrimaryServiceDeleting,
+			"primary service %s/%s is being deleted, delete this service or move it to another primary service", primary.Namespace, primary.Name)
+	}
+}
+
+func (l *LoadBalancerManager) updateFinalizer(service *v1.Service, mutate func(finalizers []string) []string) error {
+	err := l.updateService(service, func(serviceCopy *v1.Service) {
+		serviceCopy.Finalizers = mutate(serviceCopy.Finalizers)
+	})
+	if err != nil {
+		return fmt.Errorf("update finalizers of service %s/%s failed: %w", service.Namespace, service.Name, err)
+	}
+
+	logrus.Debugf("finalizer %s of service %s/%s is synced", utils.FinalizerSecondaryServices, service.Namespace, service.Name)
+	return nil
+}
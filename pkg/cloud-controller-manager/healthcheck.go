@@ -0,0 +1,99 @@
+package ccm
+
+import (
+	"fmt"
+	"strconv"
+
+	lbv1 "github.com/harvester/harvester-load-balancer/pkg/apis/loadbalancer.harvesterhci.io/v1beta1"
+	v1 "k8s.io/api/core/v1"
+
+	utils "github.com/harvester/harvester-cloud-provider/pkg/utils"
+)
+
+// getHealthCheck builds the Harvester load balancer health check from the service annotations.
+//
+// Returns (nil, nil) when the service has no health check port annotation, which disables the health check. A service
+// with the external traffic policy Local requires the annotation with the workload type cluster, kube-proxy drops the
+// traffic on the nodes without a local endpoint, and only the probe of the node port tells Harvester about them. The
+// health check node port of the service can't be used, kube-proxy answers it over HTTP on every node.
+//
+// The port annotation should match one of the service ports. As the backend servers of a cluster type load balancer
+// are the guest cluster nodes, the prober is pointed to the node port of the matched service port. A node port is
+// probed as is, which was the only accepted value before the service ports were mapped.
+func getHealthCheck(service *v1.Service) (*lbv1.HealthCheck, error) {
+	if _, ok := service.Annotations[utils.KeyHealthCheckPort]; !ok {
+		if workloadType, err := getWorkloadType(service); err == nil && workloadType == lbv1.Cluster &&
+			service.Spec.ExternalTrafficPolicy == v1.ServiceExternalTrafficPolicyLocal {
+			return nil, fmt.Errorf("service %s/%s with the external traffic policy %s requires a health check by the annotation %s, "+
+				"otherwise the traffic to the nodes without a local endpoint is dropped", service.Namespace, service.Name,
+				v1.ServiceExternalTrafficPolicyLocal, utils.KeyHealthCheckPort)
+		}
+		return nil, nil
+	}
+
+	port, err := parseHealthCheckValue(service, utils.KeyHealthCheckPort, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	backendPort, err := healthCheckBackendPort(service, port)
+	if err != nil {
+		return nil, err
+	}
+
+	healthCheck := &lbv1.HealthCheck{Port: backendPort}
+	for _, item := range []struct {
+		key          string
+		defaultValue uint
+		value        *uint
+	}{
+		{utils.KeyHealthCheckSuccessThreshold, utils.DefaultHealthCheckSuccessThreshold, &healthCheck.SuccessThreshold},
+		{utils.KeyHealthCheckFailureThreshold, utils.DefaultHealthCheckFailureThreshold, &healthCheck.FailureThreshold},
+		{utils.KeyHealthCheckPeriodSeconds, utils.DefaultHealthCheckPeriodSeconds, &healthCheck.PeriodSeconds},
+		{utils.KeyHealthCheckTimeoutSeconds, utils.DefaultHealthCheckTimeoutSeconds, &healthCheck.TimeoutSeconds},
+	} {
+		if *item.value, err = parseHealthCheckValue(service, item.key, item.defaultValue); err != nil {
+			return nil, err
+		}
+	}
+
+	return healthCheck, nil
+}
+
+// healthCheckBackendPort returns the node port of the service port matching the health check port, or the port itself
+// if it is already a node port of the service. A service port takes precedence over a node port of the same number.
+func healthCheckBackendPort(service *v1.Service, port uint) (uint, error) {
+	for _, servicePort := range service.Spec.Ports {
+		if uint(servicePort.Port) != port {
+			continue
+		}
+		if servicePort.NodePort == 0 {
+			return 0, fmt.Errorf("health check port %d of service %s/%s has no node port allocated", port, service.Namespace, service.Name)
+		}
+		return uint(servicePort.NodePort), nil
+	}
+
+	for _, servicePort := range service.Spec.Ports {
+		if uint(servicePort.NodePort) == port {
+			return port, nil
+		}
+	}
+
+	return 0, fmt.Errorf("health check port %d is neither a port nor a node port of service %s/%s", port, service.Namespace, service.Name)
+}
+
+// parseHealthCheckValue returns the positive integer value of the annotation, or the default value if it is absent.
+func parseHealthCheckValue(service *v1.Service, key string, defaultValue uint) (uint, error) {
+	valueStr, ok := service.Annotations[key]
+	if !ok {
+		return defaultValue, nil
+	}
+
+	value, err := strconv.ParseUint(valueStr, 10, 16)
+	if err != nil || value == 0 {
+		return 0, fmt.Errorf("invalid value %q of annotation %s on service %s/%s, a positive integer is expected",
+			valueStr, key, service.Namespace, service.Name)
+	}
+
+	return uint(value), nil
+}
@@ -5,12 +5,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"sync"
+	"sync/atomic"
 
 	ctlkubevirtv1 "github.com/harvester/harvester/pkg/generated/controllers/kubevirt.io/v1"
+	ctlcorev1 "github.com/rancher/wrangler/v3/pkg/generated/controllers/core/v1"
 	"github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
 	cloudprovider "k8s.io/cloud-provider"
 	kubevirtv1 "kubevirt.io/api/core/v1"
 
@@ -18,11 +21,30 @@ import (
 	utils "github.com/harvester/harvester-cloud-provider/pkg/utils"
 )
 
+// indexVMByUID indexes the VMs by their UIDs, which the provider IDs of the guest nodes are made of.
+const indexVMByUID = "harvester-cloudprovider-vm-by-uid"
+
+func vmByUID(vm *kubevirtv1.VirtualMachine) ([]string, error) {
+	return []string{string(vm.UID)}, nil
+}
+
 type instanceManager struct {
-	vmClient     ctlkubevirtv1.VirtualMachineClient
-	vmiClient    ctlkubevirtv1.VirtualMachineInstanceClient
-	nodeToVMName *sync.Map
-	namespace    string
+	vmClient ctlkubevirtv1.VirtualMachineClient
+	// vmCache is indexed by indexVMByUID
+	vmCache ctlkubevirtv1.VirtualMachineCache
+	// vmSynced reports whether vmCache is synced, it is nil in unit tests
+	vmSynced  cache.InformerSynced
+	vmiClient ctlkubevirtv1.VirtualMachineInstanceClient
+	// hostClient reads the Harvester hosts the VMIs run on
+	hostClient ctlcorev1.NodeClient
+	// hostTopologies caches the topology labels of the hosts by the host name, refer to hostTopologyTTL
+	hostTopologies sync.Map
+	// hostLookupForbidden disables reading the hosts once the Harvester account is found not permitted to
+	hostLookupForbidden atomic.Bool
+	// localNodeClient records the VMs on the guest nodes by AnnotationKeyVMNameOnNode
+	localNodeClient ctlcorev1.NodeClient
+	nodeToVMName    *sync.Map
+	namespace       string
 }
 
 func (i *instanceManager) InstanceExists(ctx context.Context, node *v1.Node) (bool, error) {
@@ -62,13 +84,8 @@ func (i *instanceManager) InstanceMetadata(ctx context.Context, node *v1.Node) (
 		return nil, err
 	}
 
-	annotations := vmi.GetAnnotations()
-	if region, ok := annotations[v1.LabelTopologyRegion]; ok {
-		meta.Region = region
-	}
-	if zone, ok := annotations[v1.LabelTopologyZone]; ok {
-		meta.Zone = zone
-	}
+	zone := i.getTopology(vmi)
+	meta.Region, meta.Zone = zone.Region, zone.FailureDomain
 
 	meta.NodeAddresses, err = getNodeAddresses(node, vmi, config.GetConfig())
 	if err != nil {
@@ -78,12 +95,81 @@ func (i *instanceManager) InstanceMetadata(ctx context.Context, node *v1.Node) (
 	return meta, nil
 }
 
+// getVM resolves the VM of the guest node by the provider ID harvester://<vm-uid> once it's set, the UID identifies the
+// VM whatever the node is named. Before that, the VM is resolved by the node, refer to vmNameOfNode. The resolved VM is
+// recorded on the node, so that the node named after the hostname is still resolved after a restart.
 func (i *instanceManager) getVM(node *v1.Node) (*kubevirtv1.VirtualMachine, error) {
-	nodeName := node.Name
-	if vmName, ok := i.nodeToVMName.Load(nodeName); ok {
-		nodeName = vmName.(string)
+	var vm *kubevirtv1.VirtualMachine
+	var err error
+	if node.Spec.ProviderID != "" {
+		vm, err = i.getVMByProviderID(node.Spec.ProviderID)
+		// The VM gets a new UID when it's restored from a backup or recreated, while the provider ID of the node can't
+		// be changed. The VM is looked up by name then, so that the node isn't deleted as its instance is gone.
+		if errors.IsNotFound(err) {
+			vmName := i.vmNameOfNode(node)
+			if vm, err = i.vmClient.Get(i.namespace, vmName, metav1.GetOptions{}); err == nil {
+				logrus.Warnf("no VM has the UID of the provider ID %s of node %s, VM %s/%s has the UID %s instead, it may have been restored or recreated",
+					node.Spec.ProviderID, node.Name, i.namespace, vmName, vm.UID)
+			}
+		}
+	} else {
+		vm, err = i.vmClient.Get(i.namespace, i.vmNameOfNode(node), metav1.GetOptions{})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	i.recordVMName(node, vm.Name)
+
+	return vm, nil
+}
+
+func (i *instanceManager) getVMByNodeName(nodeName string) (*kubevirtv1.VirtualMachine, error) {
+	vmName := nodeName
+	if name, ok := i.nodeToVMName.Load(nodeName); ok {
+		vmName = name.(string)
+	} else if i.localNodeClient != nil {
+		if node, err := i.localNodeClient.Get(nodeName, metav1.GetOptions{}); err == nil {
+			vmName = i.vmNameOfNode(node)
+		}
+	}
+	return i.vmClient.Get(i.namespace, vmName, metav1.GetOptions{})
+}
+
+// vmNameOfNode returns the name of the VM of the guest node by the annotation AnnotationKeyVMNameOnNode, then by the
+// hostname reported by the guest agent, and falls back to the node name.
+func (i *instanceManager) vmNameOfNode(node *v1.Node) string {
+	if vmName := node.Annotations[utils.AnnotationKeyVMNameOnNode]; vmName != "" {
+		return vmName
+	}
+	if vmName, ok := i.nodeToVMName.Load(node.Name); ok {
+		return vmName.(string)
+	}
+	return node.Name
+}
+
+// vmNameOf returns the name of the VM of the guest node by the provider ID once it's set, then by vmNameOfNode. The VM
+// isn't got, so the backend servers of the load balancers are resolved without a request per node.
+func (i *instanceManager) vmNameOf(node *v1.Node) string {
+	if node.Spec.ProviderID != "" {
+		if vm, err := i.getVMByProviderID(node.Spec.ProviderID); err == nil {
+			return vm.Name
+		}
+	}
+	return i.vmNameOfNode(node)
+}
+
+// recordVMName keeps the mapping of the node to its VM in memory and on the node, a failure to annotate the node only
+// logs a warning as the VM is resolved anyway.
+func (i *instanceManager) recordVMName(node *v1.Node, vmName string) {
+	i.nodeToVMName.Store(node.Name, vmName)
+
+	if i.localNodeClient == nil || node.Annotations[utils.AnnotationKeyVMNameOnNode] == vmName {
+		return
+	}
+	if err := utils.RecordVMNameOnNode(i.localNodeClient, node.Name, vmName); err != nil {
+		logrus.Warnf("record VM %s/%s on node %s failed: %v", i.namespace, vmName, node.Name, err)
 	}
-	return i.vmClient.Get(i.namespace, nodeName, metav1.GetOptions{})
 }
 
 /*
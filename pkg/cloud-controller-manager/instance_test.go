@@ -1,22 +1,28 @@
 package ccm
 
 import (
+	"context"
 	"encoding/json"
 	"net/netip"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/spf13/cobra"
 	flag "github.com/spf13/pflag"
 
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	cloudprovider "k8s.io/cloud-provider"
 	"k8s.io/cloud-provider/api"
 	kubevirtv1 "kubevirt.io/api/core/v1"
 
 	"github.com/harvester/harvester-cloud-provider/pkg/config"
 	utils "github.com/harvester/harvester-cloud-provider/pkg/utils"
+	"github.com/harvester/harvester-cloud-provider/pkg/utils/fakeclients"
 )
 
 const (
@@ -49,6 +55,13 @@ func getCommandAndFlag(mgmtNetwork, cidrRanges string, excludeList []string) (*c
 	f.StringSlice(utils.FlagCloudProviderControllers, []string{}, "")
 	f.StringSlice(utils.FlagNodeExcludeIPRanges, excludeList, "")
 	f.Bool(utils.FlagDisableAnnotationAlphaProvidedIPAddr, false, "")
+	f.Duration(utils.FlagLoadBalancerGCInterval, utils.DefaultLoadBalancerGCInterval, "")
+	f.Duration(utils.FlagLoadBalancerGCGracePeriod, utils.DefaultLoadBalancerGCGracePeriod, "")
+	f.Bool(utils.FlagLoadBalancerGCDryRun, false, "")
+	f.Bool(utils.FlagLoadBalancerDirectStatus, false, "")
+	f.String(utils.FlagLoadBalancerIPMode, "", "")
+	f.String(utils.FlagLoadBalancerHostnameTemplate, "", "")
+	f.String(utils.FlagVIPAnnouncer, utils.VIPAnnouncerKubeVip, "")
 
 	return cmd, f
 }
@@ -618,3 +631,396 @@ func Test_resolveNodeIPs(t *testing.T) {
 		})
 	}
 }
+
+func Test_zones(t *testing.T) {
+	const (
+		vmName   = "vm-0"
+		vmUID    = "vm-0-uid"
+		hostName = "harvester-0"
+	)
+	newVMI := func(hostName string) *kubevirtv1.VirtualMachineInstance {
+		return &kubevirtv1.VirtualMachineInstance{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: testNamespace,
+				Name:      vmName,
+				Annotations: map[string]string{
+					v1.LabelTopologyRegion: "stale-region",
+					v1.LabelTopologyZone:   "stale-zone",
+				},
+			},
+			Status: kubevirtv1.VirtualMachineInstanceStatus{NodeName: hostName},
+		}
+	}
+	vm := &kubevirtv1.VirtualMachine{ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: vmName, UID: vmUID}}
+	host := &v1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:   hostName,
+		Labels: map[string]string{v1.LabelTopologyRegion: "region-a", v1.LabelTopologyZone: "zone-a"},
+	}}
+
+	tests := []struct {
+		name string
+		vmi  *kubevirtv1.VirtualMachineInstance
+		want cloudprovider.Zone
+	}{
+		{
+			name: "topology of the host",
+			vmi:  newVMI(hostName),
+			want: cloudprovider.Zone{Region: "region-a", FailureDomain: "zone-a"},
+		},
+		{
+			name: "fall back to the annotations of the VMI if the host is unknown",
+			vmi:  newVMI("harvester-unknown"),
+			want: cloudprovider.Zone{Region: "stale-region", FailureDomain: "stale-zone"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vmClient := fakeclients.NewVirtualMachineClient(vm)
+			vmCache := vmClient.Cache()
+			vmCache.AddIndexer(indexVMByUID, vmByUID)
+			i := &instanceManager{
+				vmClient:     vmClient,
+				vmCache:      vmCache,
+				vmiClient:    fakeclients.NewVirtualMachineInstanceClient(tt.vmi),
+				hostClient:   fakeclients.NewNodeClient(host),
+				nodeToVMName: &sync.Map{},
+				namespace:    testNamespace,
+			}
+			i.nodeToVMName.Store("guest-0", vmName)
+
+			got, err := i.GetZoneByProviderID(context.Background(), ProviderName+"://"+vmUID)
+			if err != nil {
+				t.Fatalf("GetZoneByProviderID() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("GetZoneByProviderID() = %+v, want %+v", got, tt.want)
+			}
+			if got, err = i.GetZoneByNodeName(context.Background(), "guest-0"); err != nil || got != tt.want {
+				t.Errorf("GetZoneByNodeName() = %+v, error = %v, want %+v", got, err, tt.want)
+			}
+			t.Setenv(envNodeName, "guest-0")
+			if got, err = i.GetZone(context.Background()); err != nil || got != tt.want {
+				t.Errorf("GetZone() = %+v, error = %v, want %+v", got, err, tt.want)
+			}
+		})
+	}
+
+	vmClient := fakeclients.NewVirtualMachineClient(vm)
+	vmCache := vmClient.Cache()
+	vmCache.AddIndexer(indexVMByUID, vmByUID)
+	i := &instanceManager{vmClient: vmClient, vmCache: vmCache, namespace: testNamespace}
+	if _, err := i.GetZoneByProviderID(context.Background(), "aws:///"+vmUID); err == nil {
+		t.Errorf("GetZoneByProviderID() of a foreign provider ID succeeded")
+	}
+	i.vmSynced = func() bool { return false }
+	if _, err := i.GetZoneByProviderID(context.Background(), ProviderName+"://"+vmUID); err == nil || apierrors.IsNotFound(err) {
+		t.Errorf("GetZoneByProviderID() before the cache is synced error = %v, want an error other than NotFound", err)
+	}
+}
+
+// countingNodeClient counts the reads of the hosts, and fails them with err if it's set.
+type countingNodeClient struct {
+	*fakeclients.NodeClient
+	gets int
+	err  error
+}
+
+func (c *countingNodeClient) Get(name string, opts metav1.GetOptions) (*v1.Node, error) {
+	c.gets++
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.NodeClient.Get(name, opts)
+}
+
+func Test_getTopology(t *testing.T) {
+	const hostName = "harvester-0"
+	vmi := &kubevirtv1.VirtualMachineInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   testNamespace,
+			Name:        "vm-0",
+			Annotations: map[string]string{v1.LabelTopologyRegion: "stale-region", v1.LabelTopologyZone: "stale-zone"},
+		},
+		Status: kubevirtv1.VirtualMachineInstanceStatus{NodeName: hostName},
+	}
+	host := &v1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:   hostName,
+		Labels: map[string]string{v1.LabelTopologyRegion: "region-a", v1.LabelTopologyZone: "zone-a"},
+	}}
+
+	// the topology of the host is cached
+	hostClient := &countingNodeClient{NodeClient: fakeclients.NewNodeClient(host)}
+	i := &instanceManager{hostClient: hostClient, namespace: testNamespace}
+	for range 3 {
+		if got, want := i.getTopology(vmi), (cloudprovider.Zone{Region: "region-a", FailureDomain: "zone-a"}); got != want {
+			t.Errorf("getTopology() = %+v, want %+v", got, want)
+		}
+	}
+	if hostClient.gets != 1 {
+		t.Errorf("host is read %d times, want once", hostClient.gets)
+	}
+
+	// the lookup is disabled once it's forbidden
+	hostClient = &countingNodeClient{
+		NodeClient: fakeclients.NewNodeClient(host),
+		err:        apierrors.NewForbidden(v1.Resource("nodes"), hostName, nil),
+	}
+	i = &instanceManager{hostClient: hostClient, namespace: testNamespace}
+	for range 3 {
+		if got, want := i.getTopology(vmi), (cloudprovider.Zone{Region: "stale-region", FailureDomain: "stale-zone"}); got != want {
+			t.Errorf("getTopology() = %+v, want %+v", got, want)
+		}
+	}
+	if hostClient.gets != 1 {
+		t.Errorf("host is read %d times after forbidden, want once", hostClient.gets)
+	}
+}
+
+func Test_clusters(t *testing.T) {
+	newVM := func(name, uid, clusterName string) *kubevirtv1.VirtualMachine {
+		vm := &kubevirtv1.VirtualMachine{ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: name, UID: types.UID(uid)}}
+		if clusterName != "" {
+			vm.Labels = map[string]string{utils.LabelKeyGuestClusterNameOnVM: clusterName}
+		}
+		return vm
+	}
+	newNode := func(name, uid string) *v1.Node {
+		return &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       v1.NodeSpec{ProviderID: ProviderName + "://" + uid},
+		}
+	}
+
+	tests := []struct {
+		name         string
+		clusterName  string
+		vms          []*kubevirtv1.VirtualMachine
+		nodes        []*v1.Node
+		wantClusters []string
+		want         bool
+	}{
+		{
+			name:         "unique cluster name",
+			clusterName:  "cluster-a",
+			vms:          []*kubevirtv1.VirtualMachine{newVM("vm-0", "uid-0", "cluster-a"), newVM("vm-1", "uid-1", "cluster-b")},
+			nodes:        []*v1.Node{newNode("guest-0", "uid-0")},
+			wantClusters: []string{"cluster-a", "cluster-b"},
+			want:         true,
+		},
+		{
+			name:         "default cluster name",
+			clusterName:  utils.DefaultGuestClusterName,
+			vms:          []*kubevirtv1.VirtualMachine{newVM("vm-0", "uid-0", utils.DefaultGuestClusterName)},
+			nodes:        []*v1.Node{newNode("guest-0", "uid-0")},
+			wantClusters: []string{utils.DefaultGuestClusterName},
+		},
+		{
+			name:         "no VM labelled with the cluster name",
+			clusterName:  "cluster-a",
+			vms:          []*kubevirtv1.VirtualMachine{newVM("vm-0", "uid-0", "")},
+			nodes:        []*v1.Node{newNode("guest-0", "uid-0")},
+			wantClusters: []string{},
+		},
+		{
+			name:         "VM of a node labelled with another cluster name",
+			clusterName:  "cluster-a",
+			vms:          []*kubevirtv1.VirtualMachine{newVM("vm-0", "uid-0", "cluster-a"), newVM("vm-1", "uid-1", "cluster-b")},
+			nodes:        []*v1.Node{newNode("guest-0", "uid-0"), newNode("guest-1", "uid-1")},
+			wantClusters: []string{"cluster-a", "cluster-b"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &clusterManager{
+				vmClient:        fakeclients.NewVirtualMachineClient(tt.vms...),
+				localNodeClient: fakeclients.NewNodeClient(tt.nodes...),
+				namespace:       testNamespace,
+				clusterName:     tt.clusterName,
+				apiServer:       "https://10.53.0.1:6443",
+			}
+
+			clusters, err := c.ListClusters(context.Background())
+			if err != nil {
+				t.Fatalf("ListClusters() error = %v", err)
+			}
+			if !reflect.DeepEqual(clusters, tt.wantClusters) {
+				t.Errorf("ListClusters() = %v, want %v", clusters, tt.wantClusters)
+			}
+			if got := c.hasClusterID(); got != tt.want {
+				t.Errorf("hasClusterID() = %v, want %v", got, tt.want)
+			}
+			cloud := &CloudProvider{clusters: c}
+			if err := CheckClusterID(cloud, false); (err == nil) != tt.want {
+				t.Errorf("CheckClusterID() without untagged cloud error = %v, want cluster ID %v", err, tt.want)
+			}
+			if err := CheckClusterID(cloud, true); err != nil {
+				t.Errorf("CheckClusterID() with untagged cloud error = %v", err)
+			}
+			if master, err := c.Master(context.Background(), tt.clusterName); err != nil || master != c.apiServer {
+				t.Errorf("Master() = %q, %v, want %q", master, err, c.apiServer)
+			}
+			if _, err := c.Master(context.Background(), "cluster-unknown"); err == nil {
+				t.Errorf("Master() of an unknown cluster succeeded")
+			}
+		})
+	}
+}
+
+func Test_getVM(t *testing.T) {
+	const (
+		vmName   = "vm-0"
+		vmUID    = "vm-0-uid"
+		hostname = "guest-0"
+	)
+	vm := &kubevirtv1.VirtualMachine{ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: vmName, UID: vmUID}}
+	newNode := func(providerID string, annotations map[string]string) *v1.Node {
+		return &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: hostname, Annotations: annotations},
+			Spec:       v1.NodeSpec{ProviderID: providerID},
+		}
+	}
+
+	tests := []struct {
+		name         string
+		node         *v1.Node
+		nodeToVMName map[string]string
+		wantErr      bool
+	}{
+		{
+			name: "by the provider ID",
+			node: newNode(ProviderName+"://"+vmUID, nil),
+		},
+		{
+			name: "by the annotation",
+			node: newNode("", map[string]string{utils.AnnotationKeyVMNameOnNode: vmName}),
+		},
+		{
+			name:         "by the hostname",
+			node:         newNode("", nil),
+			nodeToVMName: map[string]string{hostname: vmName},
+		},
+		{
+			name: "the VM of the provider ID is restored with a new UID",
+			node: newNode(ProviderName+"://restored-uid", map[string]string{utils.AnnotationKeyVMNameOnNode: vmName}),
+		},
+		{
+			name:    "the VM of the provider ID is deleted",
+			node:    newNode(ProviderName+"://deleted-uid", map[string]string{utils.AnnotationKeyVMNameOnNode: "vm-deleted"}),
+			wantErr: true,
+		},
+		{
+			name:    "no VM named after the node",
+			node:    newNode("", nil),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vmClient := fakeclients.NewVirtualMachineClient(vm)
+			vmCache := vmClient.Cache()
+			vmCache.AddIndexer(indexVMByUID, vmByUID)
+			nodeClient := fakeclients.NewNodeClient(tt.node)
+			i := &instanceManager{
+				vmClient:        vmClient,
+				vmCache:         vmCache,
+				localNodeClient: nodeClient,
+				nodeToVMName:    &sync.Map{},
+				namespace:       testNamespace,
+			}
+			for nodeName, vmName := range tt.nodeToVMName {
+				i.nodeToVMName.Store(nodeName, vmName)
+			}
+
+			got, err := i.getVM(tt.node)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getVM() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.Name != vmName {
+				t.Errorf("getVM() = %s, want %s", got.Name, vmName)
+			}
+
+			// the mapping survives a restart by the annotation
+			node, err := nodeClient.Get(hostname, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("get node failed: %v", err)
+			}
+			if vmName := node.Annotations[utils.AnnotationKeyVMNameOnNode]; vmName != got.Name {
+				t.Errorf("annotation %s = %q, want %q", utils.AnnotationKeyVMNameOnNode, vmName, got.Name)
+			}
+			i.nodeToVMName = &sync.Map{}
+			if got, err := i.getVMByNodeName(hostname); err != nil || got.Name != vmName {
+				t.Errorf("getVMByNodeName() after restart = %v, %v, want %s", got, err, vmName)
+			}
+		})
+	}
+}
+
+func Test_vmNameOf(t *testing.T) {
+	const (
+		vmName   = "vm-0"
+		vmUID    = "vm-0-uid"
+		hostname = "guest-0"
+	)
+	vm := &kubevirtv1.VirtualMachine{ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: vmName, UID: vmUID}}
+	newNode := func(providerID string, annotations map[string]string) *v1.Node {
+		return &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: hostname, Annotations: annotations},
+			Spec:       v1.NodeSpec{ProviderID: providerID},
+		}
+	}
+
+	tests := []struct {
+		name         string
+		node         *v1.Node
+		nodeToVMName map[string]string
+		want         string
+	}{
+		{
+			name: "by the provider ID",
+			node: newNode(ProviderName+"://"+vmUID, map[string]string{utils.AnnotationKeyVMNameOnNode: "vm-stale"}),
+			want: vmName,
+		},
+		{
+			name: "by the annotation if the VM of the provider ID is restored with a new UID",
+			node: newNode(ProviderName+"://restored-uid", map[string]string{utils.AnnotationKeyVMNameOnNode: vmName}),
+			want: vmName,
+		},
+		{
+			name: "by the annotation",
+			node: newNode("", map[string]string{utils.AnnotationKeyVMNameOnNode: vmName}),
+			want: vmName,
+		},
+		{
+			name:         "by the hostname",
+			node:         newNode("", nil),
+			nodeToVMName: map[string]string{hostname: vmName},
+			want:         vmName,
+		},
+		{
+			name: "by the node name",
+			node: newNode("", nil),
+			want: hostname,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vmCache := fakeclients.NewVirtualMachineClient(vm).Cache()
+			vmCache.AddIndexer(indexVMByUID, vmByUID)
+			i := &instanceManager{vmCache: vmCache, nodeToVMName: &sync.Map{}, namespace: testNamespace}
+			for nodeName, vmName := range tt.nodeToVMName {
+				i.nodeToVMName.Store(nodeName, vmName)
+			}
+			l := &LoadBalancerManager{vmNames: i}
+			if got := l.vmNameOfNode(tt.node); got != tt.want {
+				t.Errorf("vmNameOfNode() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package ccm
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+
+	utils "github.com/harvester/harvester-cloud-provider/pkg/utils"
+)
+
+// familyLoadBalancer is the Harvester load balancer allocating the address of one IP family of the primary service.
+type familyLoadBalancer struct {
+	name string
+	// family is empty when the service doesn't specify spec.ipFamilies
+	family v1.IPFamily
+	// index is the position of the family in spec.ipFamilies of the service, the IP pool annotation is indexed by it
+	index int
+}
+
+// isDualStack reports whether the service asks for an address of each IP family.
+func isDualStack(service *v1.Service) bool {
+	policy := service.Spec.IPFamilyPolicy
+	if policy == nil || len(service.Spec.IPFamilies) < 2 {
+		return false
+	}
+	return *policy == v1.IPFamilyPolicyPreferDualStack || *policy == v1.IPFamilyPolicyRequireDualStack
+}
+
+// isDualStackRequired reports whether the service fails without an address of the second IP family.
+func isDualStackRequired(service *v1.Service) bool {
+	return service.Spec.IPFamilyPolicy != nil && *service.Spec.IPFamilyPolicy == v1.IPFamilyPolicyRequireDualStack
+}
+
+// hasFamilyIPPools reports whether the service pins an IP pool per IP family. The Harvester load balancer doesn't
+// select the pool by the IP family, so an automatically selected pool or DHCP may allocate an address of the other
+// family.
+func hasFamilyIPPools(service *v1.Service) bool {
+	return getIPPool(service, 0) != "" && getIPPool(service, 1) != ""
+}
+
+// getFamilyLoadBalancers returns the load balancers of the primary service, one per IP family. The load balancer of
+// the first family keeps the name of the single stack load balancer, so that an existing service can be upgraded to
+// dual-stack without recreating it. A PreferDualStack service without a pool per family stays single stack, while a
+// RequireDualStack one is rejected by checkAllocationRequest.
+//
+// The names are derived from the service unless they are taken over from another service by the annotation
+// KeyLoadBalancerName, e.g. when the service is promoted from a secondary service.
+func getFamilyLoadBalancers(clusterName string, service *v1.Service) []familyLoadBalancer {
+	names := loadBalancerNameOverrides(service)
+
+	flbs := []familyLoadBalancer{{
+		name: loadBalancerName(clusterName, service.Namespace, service.Name, string(service.UID)),
+	}}
+	if len(names) > 0 {
+		flbs[0].name = names[0]
+	}
+	if len(service.Spec.IPFamilies) == 0 {
+		return flbs
+	}
+
+	flbs[0].family = service.Spec.IPFamilies[0]
+	if isDualStack(service) && (hasFamilyIPPools(service) || isDualStackRequired(service)) {
+		family := service.Spec.IPFamilies[1]
+		name := familyLoadBalancerName(clusterName, service, family)
+		if len(names) > 1 {
+			name = names[1]
+		}
+		flbs = append(flbs, familyLoadBalancer{
+			name:   name,
+			family: family,
+			index:  1,
+		})
+	}
+
+	return flbs
+}
+
+// loadBalancerFamilies returns the IP families of the load balancers of the primary service.
+func loadBalancerFamilies(clusterName string, service *v1.Service) []v1.IPFamily {
+	flbs := getFamilyLoadBalancers(clusterName, service)
+	families := make([]v1.IPFamily, 0, len(flbs))
+	for _, flb := range flbs {
+		families = append(families, flb.family)
+	}
+	return families
+}
+
+// loadBalancerNameOverrides returns the names of the load balancers in the annotation KeyLoadBalancerName, in the
+// order of the IP families.
+func loadBalancerNameOverrides(service *v1.Service) []string {
+	value := service.Annotations[utils.KeyLoadBalancerName]
+	if value == "" {
+		return nil
+	}
+
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// allLoadBalancerNames returns the names of all load balancers the service may own regardless of its current IP
+// families, the ones owned by other services are skipped when they are deleted.
+func allLoadBalancerNames(clusterName string, service *v1.Service) []string {
+	names := append(loadBalancerNameOverrides(service),
+		loadBalancerName(clusterName, service.Namespace, service.Name, string(service.UID)),
+		familyLoadBalancerName(clusterName, service, v1.IPv4Protocol),
+		familyLoadBalancerName(clusterName, service, v1.IPv6Protocol),
+	)
+	// the load balancers created by an unfinished network migration
+	if network := service.Annotations[utils.KeyNetwork]; isNetworkMigrationAllowed(service) {
+		for _, family := range []v1.IPFamily{"", v1.IPv4Protocol, v1.IPv6Protocol} {
+			names = append(names, migrationLoadBalancerName(clusterName, service, family, network))
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// familyLoadBalancerName returns the name of the load balancer allocating the address of the second IP family.
+func familyLoadBalancerName(clusterName string, service *v1.Service, family v1.IPFamily) string {
+	return loadBalancerName(clusterName, service.Namespace, service.Name, string(service.UID)+"-"+strings.ToLower(string(family)))
+}
+
+// ipFamilyOf returns the IP family of the IP, or an empty family if it is malformed.
+func ipFamilyOf(ip string) v1.IPFamily {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	if addr.Is4() || addr.Is4In6() {
+		return v1.IPv4Protocol
+	}
+	return v1.IPv6Protocol
+}
+
+// ingressIPOfFamily returns the first ingress IP of the family in the status of the service, any family matches an
+// empty family.
+func ingressIPOfFamily(service *v1.Service, family v1.IPFamily) string {
+	for _, ingress := range service.Status.LoadBalancer.Ingress {
+		if ingress.IP != "" && (family == "" || ipFamilyOf(ingress.IP) == family) {
+			return ingress.IP
+		}
+	}
+	return ""
+}
+
+// ingressIPs returns all ingress IPs of the service separated by comma, which is the format of the kube-vip annotation.
+func ingressIPs(service *v1.Service) string {
+	ips := make([]string, 0, len(service.Status.LoadBalancer.Ingress))
+	for _, ingress := range service.Status.LoadBalancer.Ingress {
+		if ingress.IP != "" {
+			ips = append(ips, ingress.IP)
+		}
+	}
+	return strings.Join(ips, ",")
+}
@@ -0,0 +1,143 @@
+package ccm
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	lbv1 "github.com/harvester/harvester-load-balancer/pkg/apis/loadbalancer.harvesterhci.io/v1beta1"
+	"github.com/harvester/harvester-load-balancer/pkg/ipam"
+	lbutils "github.com/harvester/harvester-load-balancer/pkg/utils"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	utils "github.com/harvester/harvester-cloud-provider/pkg/utils"
+)
+
+// checkAllocationRequest rejects a requested IP and validates the IPPool of the primary service for the IP family of
+// the load balancer.
+//
+// The pool is only validated before the load balancer is created. Once the load balancer exists, it must be the same as
+// the one recorded on it, as the allocated IP can't be moved to another pool, just like the network. The only exception
+// is the first family of a service upgraded to dual-stack, whose load balancer was created without a pool.
+func (l *LoadBalancerManager) checkAllocationRequest(service *v1.Service, clusterName string, flb familyLoadBalancer, lb *lbv1.LoadBalancer) error {
+	if err := l.checkRequestedIP(service); err != nil {
+		return err
+	}
+
+	poolName := getIPPool(service, flb.index)
+
+	if service.Annotations[utils.KeyIPAM] == string(lbv1.DHCP) && !l.announcer.LeasesDHCP() {
+		return fmt.Errorf("ipam mode %s of service %s/%s requires a VIP announcer leasing the address from the DHCP server, "+
+			"check the flag --%s", lbv1.DHCP, service.Namespace, service.Name, utils.FlagVIPAnnouncer)
+	}
+
+	if lb != nil {
+		// A single stack service upgraded to dual-stack pins the pools per family, while the existing load balancer
+		// of the first family keeps the pool selected automatically, only the load balancer of the second family is new.
+		if lb.Spec.IPPool == "" && flb.index == 0 && isDualStack(service) && hasFamilyIPPools(service) {
+			return checkWorkloadTypeChanged(service, lb)
+		}
+		if lb.Spec.IPPool != poolName {
+			return fmt.Errorf("ip pool annotation of service %s/%s is not same as the load balancer %s/%s, service: '%s', lb: '%s'",
+				service.Namespace, service.Name, lb.Namespace, lb.Name, poolName, lb.Spec.IPPool)
+		}
+		return checkWorkloadTypeChanged(service, lb)
+	}
+
+	if poolName == "" {
+		if isDualStack(service) && isDualStackRequired(service) {
+			return fmt.Errorf("dual-stack service %s/%s requires one ip pool per ip family by the annotation %s, "+
+				"the pool selected automatically may allocate an address of the other family", service.Namespace, service.Name, utils.KeyIPPool)
+		}
+		return nil
+	}
+
+	if ipamStr, ok := service.Annotations[utils.KeyIPAM]; ok && lbv1.IPAM(ipamStr) != lbv1.Pool {
+		return fmt.Errorf("ip pool %s of service %s/%s requires the ipam mode %s, got %s", poolName, service.Namespace, service.Name, lbv1.Pool, ipamStr)
+	}
+
+	pool, err := l.ipPoolClient.Get(poolName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("get ip pool %s of service %s/%s failed: %w", poolName, service.Namespace, service.Name, err)
+	}
+
+	if err := validateIPPool(pool, service, clusterName, l.namespace); err != nil {
+		return err
+	}
+
+	if flb.family != "" && !isIPPoolOfFamily(pool, flb.family) {
+		return fmt.Errorf("ip pool %s of service %s/%s has ranges not of the ip family %s", pool.Name, service.Namespace, service.Name, flb.family)
+	}
+
+	return nil
+}
+
+// isIPPoolOfFamily reports whether all the ranges of the pool are of the IP family.
+func isIPPoolOfFamily(pool *lbv1.IPPool, family v1.IPFamily) bool {
+	for _, r := range pool.Spec.Ranges {
+		prefix, err := netip.ParsePrefix(r.Subnet)
+		if err != nil || ipFamilyOf(prefix.Addr().String()) != family {
+			return false
+		}
+	}
+	return true
+}
+
+// checkRequestedIP rejects the field spec.loadBalancerIP and the annotation KeyRequestedIP of the service. The Harvester
+// LoadBalancer allocates the next free IP of the pool and only reuses the IP allocated to the same LoadBalancer before,
+// so a requested IP can't be honored.
+func (l *LoadBalancerManager) checkRequestedIP(service *v1.Service) error {
+	requestedIP := service.Annotations[utils.KeyRequestedIP]
+	if requestedIP == "" {
+		requestedIP = service.Spec.LoadBalancerIP
+	}
+	if requestedIP == "" {
+		return nil
+	}
+
+	l.recordEvent(service, v1.EventTypeWarning, eventReasonRequestedIPNotSupported,
+		"requested ip %s is not supported, remove spec.loadBalancerIP and the annotation %s", requestedIP, utils.KeyRequestedIP)
+	return fmt.Errorf("service %s/%s requests ip %s, but a specific ip can't be requested from the Harvester load balancer",
+		service.Namespace, service.Name, requestedIP)
+}
+
+// validateIPPool checks the selector of the pool the same way as the Harvester load balancer controller matches a pool
+// for a cluster type load balancer, the network must be the same and one of the scopes must cover the guest cluster.
+// A global pool has no selector and is available to everyone.
+func validateIPPool(pool *lbv1.IPPool, service *v1.Service, clusterName, namespace string) error {
+	if pool.Labels[lbutils.KeyGlobalIPPool] == lbutils.ValueTrue {
+		return nil
+	}
+
+	r := &ipam.Requirement{
+		Network:   service.Annotations[utils.KeyNetwork],
+		Project:   service.Annotations[utils.KeyProject],
+		Namespace: service.Annotations[utils.KeyNamespace],
+		Cluster:   clusterName,
+	}
+	if r.Namespace == "" {
+		r.Namespace = namespace
+	}
+
+	if pool.Spec.Selector.Network != r.Network {
+		return fmt.Errorf("network of ip pool %s is '%s', but service %s/%s requests network '%s'",
+			pool.Name, pool.Spec.Selector.Network, service.Namespace, service.Name, r.Network)
+	}
+
+	if !ipam.NewMatcherWithMode(pool.Spec.Selector, true).Matches(r) {
+		return fmt.Errorf("scope of ip pool %s doesn't cover guest cluster %s in namespace %s", pool.Name, r.Cluster, r.Namespace)
+	}
+
+	return nil
+}
+
+// getIPPool returns the IP pool of the IP family at the index of spec.ipFamilies. A dual-stack service can set one
+// pool per family separated by comma in the same order as spec.ipFamilies.
+func getIPPool(service *v1.Service, index int) string {
+	pools := strings.Split(service.Annotations[utils.KeyIPPool], ",")
+	if index >= len(pools) {
+		return ""
+	}
+	return strings.TrimSpace(pools[index])
+}
@@ -2,34 +2,52 @@ package ccm
 
 import (
 	"context"
+	goerrors "errors"
 	"fmt"
 	"hash/crc32"
+	"slices"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
 	lbv1 "github.com/harvester/harvester-load-balancer/pkg/apis/loadbalancer.harvesterhci.io/v1beta1"
 	pkgctllb "github.com/harvester/harvester-load-balancer/pkg/controller/loadbalancer"
+	ctldiscoveryv1 "github.com/harvester/harvester-load-balancer/pkg/generated/controllers/discovery.k8s.io/v1"
 	ctllbv1 "github.com/harvester/harvester-load-balancer/pkg/generated/controllers/loadbalancer.harvesterhci.io/v1beta1"
 	wranglecorev1 "github.com/rancher/wrangler/v3/pkg/generated/controllers/core/v1"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
-	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/retry"
+	"k8s.io/cloud-provider/api"
 
 	cfg "github.com/harvester/harvester-cloud-provider/pkg/config"
 	utils "github.com/harvester/harvester-cloud-provider/pkg/utils"
 )
 
 const (
-	retryTimes    = 10
-	retryInterval = time.Second
 	maxNameLength = 63
 	lenOfSuffix   = 8
+
+	// pendingRetryInterval is the fallback to requeue the service waiting for the allocated IP, the service is
+	// normally updated by the load balancer handler as soon as the IP is allocated.
+	pendingRetryInterval = 30 * time.Second
+
+	eventReasonInvalidHealthCheck      = "InvalidHealthCheck"
+	eventReasonRequestedIPNotSupported = "RequestedIPNotSupported"
+	eventReasonIPFamilyNotAllocated    = "IPFamilyNotAllocated"
+	eventReasonIPFamilySkipped         = "IPFamilySkipped"
+)
+
+var (
+	errAllocationPending = goerrors.New("ip is not allocated yet")
+	errIPFamilyMismatch  = goerrors.New("allocated ip is not of the requested ip family")
 )
 
 // Primary service is the load balancer service which will be used to create the load balancer.
@@ -37,30 +55,55 @@ const (
 
 type LoadBalancerManager struct {
 	lbClient       ctllbv1.LoadBalancerClient
+	ipPoolClient   ctllbv1.IPPoolClient
 	localSvcClient wranglecorev1.ServiceClient
 	localSvcCache  wranglecorev1.ServiceCache
 	configMapCache wranglecorev1.ConfigMapCache
-	namespace      string
+	// the endpoint slices and the nodes restrict the backend servers of the services with the external traffic policy Local
+	localEndpointSliceCache ctldiscoveryv1.EndpointSliceCache
+	localNodeCache          wranglecorev1.NodeCache
+	namespace               string
+	// vmNames resolves the VMs of the guest nodes for the backend servers
+	vmNames vmNameResolver
+	// directStatus returns the load balancer status built from the allocated addresses instead of leaving it to kube-vip
+	directStatus     bool
+	ipMode           v1.LoadBalancerIPMode
+	hostnameTemplate *template.Template
+	// announcer annotates the services for the agent announcing the addresses
+	announcer Announcer
+	// retainStableLoadBalancers keeps the load balancers of the deleted services with stable names, it's only enabled
+	// when the garbage collection deletes them if they are not adopted
+	retainStableLoadBalancers bool
+
+	// recorder is set when the cloud provider is initialized, it is nil in unit tests.
+	recorder record.EventRecorder
+}
+
+func (l *LoadBalancerManager) recordEvent(service *v1.Service, eventType, reason, messageFmt string, args ...interface{}) {
+	if l.recorder == nil {
+		return
+	}
+	l.recorder.Eventf(service, eventType, reason, messageFmt, args...)
 }
 
 func (l *LoadBalancerManager) GetLoadBalancer(ctx context.Context, clusterName string, service *v1.Service) (status *v1.LoadBalancerStatus, exists bool, err error) {
 	name := l.GetLoadBalancerName(ctx, clusterName, service)
-	// If using loadbalancer cache here, the cloud provider will need a serviceAccount binding with a clusterrole which
-	// includes the privilege to list and watch the load balancers in all namespaces, whereas the client only needs to
-	// be allowed to get the load balancer in the specified namespace. Following the principle of least privilege, we
-	// choose the client instead of the cache to get the load balancer.
-	lb, err := l.lbClient.Get(l.namespace, name, metav1.GetOptions{})
+	// The client is used instead of the cache, the load balancer may be just created by the last sync and not in the
+	// cache yet.
+	_, err = l.lbClient.Get(l.namespace, name, metav1.GetOptions{})
 	if err != nil {
 		if errors.IsNotFound(err) {
+			// EnsureLoadBalancerDeleted is only called for an existing load balancer, report it existing to release the
+			// finalizer of the primary service.
+			if slices.Contains(service.Finalizers, utils.FinalizerSecondaryServices) {
+				return &service.Status.LoadBalancer, true, nil
+			}
 			return nil, false, nil
 		}
 		return nil, false, err
 	}
 
-	if lb.Status.Address == "" {
-		return nil, false, nil
-	}
-
+	// The load balancer exists even if the IP is not allocated yet, so that it's deleted together with the service.
 	return &service.Status.LoadBalancer, true, nil
 }
 
@@ -69,7 +112,7 @@ func (l *LoadBalancerManager) GetLoadBalancerName(ctx context.Context, clusterNa
 	if err != nil || svc == nil {
 		svc = service
 	}
-	return loadBalancerName(clusterName, svc.Namespace, svc.Name, string(svc.UID))
+	return getFamilyLoadBalancers(clusterName, svc)[0].name
 }
 
 // The name must be a valid [RFC 1035 label name](https://kubernetes.io/docs/concepts/overview/working-with-objects/names/#dns-label-names).
@@ -173,36 +216,98 @@ func (l *LoadBalancerManager) EnsureLoadBalancer(ctx context.Context, clusterNam
 		return l.ensureSecondaryLoadBalancer(clusterName, primarySvc, service)
 	}
 
-	return l.ensurePrimaryLoadBalancer(clusterName, service)
+	return l.ensurePrimaryLoadBalancer(clusterName, service, nodes)
 }
 
 // ensurePrimaryLoadBalancer is to create/update a Harvester load balancer for the primary service
 //  1. Create/update harvester load balancer.
 //     If the service has an external IP set by kube-vip, update it into the load balancer.
-//  2. Wait for the harvester load balancer to get the allocated IP address
-//  3. Set the allocated IP address into the field spec.loadBalancerIP of the service.
-//     The kube-vip will set the external IP according to the spec.loadBalancerIP.
-func (l *LoadBalancerManager) ensurePrimaryLoadBalancer(clusterName string, service *v1.Service) (*v1.LoadBalancerStatus, error) {
-	name := loadBalancerName(clusterName, service.Namespace, service.Name, string(service.UID))
+//     A dual-stack service gets one harvester load balancer per IP family.
+//  2. Check whether the harvester load balancers have allocated the IP addresses.
+//     If not, return a retry error instead of waiting. The service will be updated by OnLoadBalancerChanged once
+//     the addresses are allocated.
+//  3. Set the allocated IP addresses into the annotation of the announcer of the service, separated by comma.
+//     The announcer, e.g. kube-vip, will set the external IPs according to the annotation.
+func (l *LoadBalancerManager) ensurePrimaryLoadBalancer(clusterName string, service *v1.Service, nodes []*v1.Node) (*v1.LoadBalancerStatus, error) {
+	if isStableNameEnabled(service) {
+		var err error
+		if service, err = l.pinLoadBalancerNames(clusterName, service); err != nil {
+			return nil, err
+		}
+	}
+	flbs := getFamilyLoadBalancers(clusterName, service)
+	if isDualStack(service) && len(flbs) == 1 {
+		l.recordEvent(service, v1.EventTypeWarning, eventReasonIPFamilySkipped,
+			"no %s address is allocated without an ip pool per ip family by the annotation %s, fall back to single stack",
+			service.Spec.IPFamilies[1], utils.KeyIPPool)
+	}
 
-	if err := l.checkNetworkChanged(service, name, false); err != nil {
+	// the service may be a secondary service before
+	if err := l.syncFormerPrimaryService(service, ""); err != nil {
 		return nil, err
 	}
 
-	if err := l.createOrUpdateLoadBalancer(name, clusterName, service); err != nil {
-		return nil, fmt.Errorf("create or update lb %s/%s failed, error: %w", l.namespace, name, err)
+	// the ports of the primary service must not overlap with the ports reserved by the secondary services
+	if err := l.checkPrimaryPorts(service); err != nil {
+		l.recordPortConflict(service, err)
+		return nil, fmt.Errorf("check port overlap failed, primary service: %s/%s, error: %w", service.Namespace, service.Name, err)
+	}
+
+	// the load balancers are got once and passed down to the checks, the updates and the allocation
+	lbs := make([]*lbv1.LoadBalancer, len(flbs))
+	for i, flb := range flbs {
+		lb, err := l.getLoadBalancer(flb.name)
+		if err != nil {
+			return nil, err
+		}
+		lbs[i] = lb
+	}
+
+	// the load balancers are recreated on the new network if the network annotation is changed on purpose
+	if isNetworkMigrationAllowed(service) && isNetworkMigrating(service, lbs) {
+		return l.migrateNetwork(clusterName, service, flbs, nodes)
 	}
 
-	if err := l.updatePrimaryServiceLoadBalancerIP(name, service); err != nil {
-		// Delete the load balancer if the service is not updated successfully.
-		// If ensure service failed, the load balancer could not be deleted even though the service is deleted.
-		if err := l.deleteLoadBalancer(clusterName, service); err != nil {
-			return nil, fmt.Errorf("delete lb %s/%s failed, error: %w", l.namespace, name, err)
+	for i, flb := range flbs {
+		if err := l.claimLoadBalancer(flb.name, lbs[i], clusterName, service); err != nil {
+			return nil, err
+		}
+
+		if err := checkNetworkChanged(service, lbs[i], false); err != nil {
+			return nil, err
+		}
+
+		if err := l.checkAllocationRequest(service, clusterName, flb, lbs[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, flb := range flbs {
+		lb, err := l.createOrUpdateLoadBalancer(flb, lbs[i], clusterName, service, nodes)
+		if err != nil {
+			return nil, fmt.Errorf("create or update lb %s/%s failed, error: %w", l.namespace, flb.name, err)
+		}
+		lbs[i] = lb
+	}
+
+	// The load balancers are kept on failure, they are deleted together with the service as GetLoadBalancer reports
+	// them existing. A new load balancer would get the same IP from the pool history again anyway.
+	ips, err := l.updatePrimaryServiceLoadBalancerIP(flbs, lbs, service)
+	if err != nil {
+		if goerrors.Is(err, errAllocationPending) {
+			return nil, api.NewRetryError(err.Error(), pendingRetryInterval)
 		}
 		return nil, fmt.Errorf("update load balancer IP of service %s/%s failed, error: %w", service.Namespace, service.Name, err)
 	}
 
-	return &service.Status.LoadBalancer, nil
+	// the service may be downgraded from dual-stack to single stack
+	if len(flbs) == 1 {
+		if err := l.deleteFamilyLoadBalancers(clusterName, service); err != nil {
+			return nil, err
+		}
+	}
+
+	return l.loadBalancerStatus(clusterName, service, ips)
 }
 
 // ensureSecondaryLoadBalancer is to create/update a Harvester load balancer for the secondary service
@@ -210,14 +315,18 @@ func (l *LoadBalancerManager) ensureSecondaryLoadBalancer(clusterName string, pr
 	if len(primary.Status.LoadBalancer.Ingress) == 0 {
 		return nil, fmt.Errorf("primary service %s/%s has no ingress IP", primary.Namespace, primary.Name)
 	}
-	// check if the port of the secondary service overlaps with the primary service and other secondary services
-	if err := l.checkPortOverlap(primary, secondary); err != nil {
+	// reserve the ports of the secondary service, they must not overlap with the primary service and other secondary services
+	if err := l.reservePorts(primary, secondary); err != nil {
+		l.recordPortConflict(secondary, err)
 		return nil, fmt.Errorf("check port overlap failed, primary service: %s/%s, secondary service: %s/%s, error: %w",
 			primary.Namespace, primary.Name, secondary.Namespace, secondary.Name, err)
 	}
 
-	primaryLBName := loadBalancerName(clusterName, primary.Namespace, primary.Name, string(primary.UID))
-	if err := l.checkNetworkChanged(secondary, primaryLBName, true); err != nil {
+	primaryLB, err := l.getLoadBalancer(getFamilyLoadBalancers(clusterName, primary)[0].name)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkNetworkChanged(secondary, primaryLB, true); err != nil {
 		return nil, err
 	}
 
@@ -225,8 +334,21 @@ func (l *LoadBalancerManager) ensureSecondaryLoadBalancer(clusterName string, pr
 	if err := l.deleteLoadBalancer(clusterName, secondary); err != nil {
 		return nil, err
 	}
-	// update secondary service load balancer IP
-	return &secondary.Status.LoadBalancer, l.updateSecondaryServiceLoadBalancerIP(primary.Status.LoadBalancer.Ingress[0].IP, primary, secondary)
+	if err := l.syncFormerPrimaryService(secondary, primaryServiceLabelValue(primary)); err != nil {
+		return nil, err
+	}
+
+	// update secondary service load balancer IP, it inherits the IPs of all families of the primary service
+	if err := l.updateSecondaryServiceLoadBalancerIP(ingressIPs(primary), primary, secondary); err != nil {
+		return nil, err
+	}
+
+	// protect the primary service from being deleted while the secondary service shares its load balancer
+	if err := l.syncSecondaryServicesFinalizer(primary, ""); err != nil {
+		return nil, err
+	}
+
+	return l.loadBalancerStatus(clusterName, secondary, strings.Split(ingressIPs(primary), ","))
 }
 
 func (l *LoadBalancerManager) UpdateLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) error {
@@ -241,8 +363,27 @@ func (l *LoadBalancerManager) EnsureLoadBalancerDeleted(ctx context.Context, clu
 	if err != nil {
 		return err
 	}
-	// do nothing for the secondary service
+	// the load balancer is kept for the secondary service, but the primary service is released if it's the last one
 	if primarySvc != nil {
+		if err := l.releasePorts(primarySvc, service); err != nil {
+			return err
+		}
+		return l.syncSecondaryServicesFinalizer(primarySvc, service.UID)
+	}
+
+	if service.DeletionTimestamp != nil && isPromotionEnabled(service) {
+		promoted, err := l.promoteSecondaryService(clusterName, service)
+		if err != nil {
+			return err
+		}
+		if promoted {
+			return nil
+		}
+	}
+
+	if l.isLoadBalancerRetained(service) {
+		logrus.Infof("load balancers %v of deleted service %s/%s are retained for adoption", loadBalancerNameOverrides(service),
+			service.Namespace, service.Name)
 		return nil
 	}
 
@@ -260,21 +401,31 @@ func warnClusterName(logger logrus.FieldLogger, lbName, clusterName string) {
 	}
 }
 
-func (l *LoadBalancerManager) createOrUpdateLoadBalancer(name, clusterName string, service *v1.Service) error {
-	lb, err := l.lbClient.Get(l.namespace, name, metav1.GetOptions{})
-	if err != nil && !errors.IsNotFound(err) {
-		return err
+// createOrUpdateLoadBalancer creates the load balancer if lb is nil, or updates lb. The created or updated load balancer
+// is returned.
+func (l *LoadBalancerManager) createOrUpdateLoadBalancer(flb familyLoadBalancer, lb *lbv1.LoadBalancer, clusterName string, service *v1.Service, nodes []*v1.Node) (*lbv1.LoadBalancer, error) {
+	newLB, err := l.constructLB(lb, service, flb, clusterName, nodes)
+	if err != nil {
+		return nil, err
 	}
-
-	newLB := l.constructLB(lb, service, name, clusterName)
-	if errors.IsNotFound(err) {
-		warnClusterName(logrus.StandardLogger(), name, clusterName)
-		_, err = l.lbClient.Create(newLB)
-	} else {
-		_, err = l.lbClient.Update(newLB)
+	if lb == nil {
+		warnClusterName(logrus.StandardLogger(), flb.name, clusterName)
+		return l.lbClient.Create(newLB)
 	}
 
-	return err
+	return l.lbClient.Update(newLB)
+}
+
+// getLoadBalancer returns the load balancer of the name, or nil if it doesn't exist.
+func (l *LoadBalancerManager) getLoadBalancer(name string) (*lbv1.LoadBalancer, error) {
+	lb, err := l.lbClient.Get(l.namespace, name, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("get lb %s/%s failed: %w", l.namespace, name, err)
+	}
+	return lb, nil
 }
 
 // patchLB prepares the LoadBalancer resource by normalizing and prioritizing
@@ -317,7 +468,7 @@ func patchLB(lb *lbv1.LoadBalancer) {
 	// LoadBalancer controller will trigger its internal fallback discovery logic.
 }
 
-func (l *LoadBalancerManager) constructLB(oldLB *lbv1.LoadBalancer, service *v1.Service, name, clusterName string) *lbv1.LoadBalancer {
+func (l *LoadBalancerManager) constructLB(oldLB *lbv1.LoadBalancer, service *v1.Service, flb familyLoadBalancer, clusterName string, nodes []*v1.Node) (*lbv1.LoadBalancer, error) {
 	var lb *lbv1.LoadBalancer
 
 	// If the error returned by Get Interface is ErrNotFound, the returned lb would not be nil, but the name of the lb is empty.
@@ -328,7 +479,7 @@ func (l *LoadBalancerManager) constructLB(oldLB *lbv1.LoadBalancer, service *v1.
 			},
 			ObjectMeta: metav1.ObjectMeta{
 				Namespace: l.namespace,
-				Name:      name,
+				Name:      flb.name,
 			},
 		}
 	} else {
@@ -347,11 +498,19 @@ func (l *LoadBalancerManager) constructLB(oldLB *lbv1.LoadBalancer, service *v1.
 
 		// keep original network request from the service at the first time if it presents, and don't overwrite it again if lb exists
 		lb.Annotations[utils.AnnotationKeyNetworkOnLB] = service.Annotations[utils.KeyNetwork]
+
+		// the same as network, the ip pool is only set at the first time
+		lb.Spec.IPPool = getIPPool(service, flb.index)
+	}
+
+	if flb.family != "" {
+		lb.Annotations[utils.AnnotationKeyIPFamilyOnLB] = string(flb.family)
 	}
 
 	lb.Annotations[pkgctllb.AnnotationKeyProject] = service.Annotations[utils.KeyProject]
 	lb.Annotations[pkgctllb.AnnotationKeyNamespace] = service.Annotations[utils.KeyNamespace]
 	lb.Annotations[pkgctllb.AnnotationKeyCluster] = clusterName
+	lb.Annotations[utils.AnnotationKeyServiceUIDOnLB] = string(service.UID)
 
 	if lb.Labels == nil {
 		lb.Labels = make(map[string]string)
@@ -368,104 +527,197 @@ func (l *LoadBalancerManager) constructLB(oldLB *lbv1.LoadBalancer, service *v1.
 		ipam = lbv1.IPAM(ipamStr)
 	}
 	lb.Spec.IPAM = ipam
-	lb.Spec.WorkloadType = lbv1.Cluster
+	lb.Spec.Listeners = getListeners(service)
+	if err := l.setBackendServers(lb, service, nodes); err != nil {
+		return nil, err
+	}
 
-	if len(service.Status.LoadBalancer.Ingress) > 0 {
-		lb.Status.Address = service.Status.LoadBalancer.Ingress[0].IP
+	if err := l.setHealthCheck(lb, service); err != nil {
+		return nil, err
 	}
 
-	return lb
+	if ip := ingressIPOfFamily(service, flb.family); ip != "" {
+		lb.Status.Address = ip
+	}
+
+	return lb, nil
 }
 
-// only retry when conflict happens
-func (l *LoadBalancerManager) retryUpdateService(service *v1.Service, serviceType, ip, primaryLabel string, updateServiceObject func(serviceCopy *v1.Service, ip, primaryLabel string)) error {
-	retryFunc := func() error {
-		newService, err := l.localSvcCache.Get(service.Namespace, service.Name)
-		if err != nil {
-			return fmt.Errorf("failed to get %s service %s/%s to update ip %s, error: %w", serviceType, service.Namespace, service.Name, ip, err)
+// getListeners converts every port of the service into a listener, the node port is the backend port as the backend
+// servers are the guest cluster nodes. The listeners are rebuilt on every update, so that added, changed and removed
+// service ports are reflected on the load balancer.
+func getListeners(service *v1.Service) []lbv1.Listener {
+	if len(service.Spec.Ports) == 0 {
+		return nil
+	}
+
+	listeners := make([]lbv1.Listener, 0, len(service.Spec.Ports))
+	for _, port := range service.Spec.Ports {
+		protocol := port.Protocol
+		if protocol == "" {
+			protocol = v1.ProtocolTCP
 		}
-		// skip updating if UID has changed, it means service has been recreated by other controller
-		if newService.UID != service.UID {
-			return fmt.Errorf("failed to get %s service %s/%s to update ip %s, UID %v has changed to %v", serviceType, service.Namespace, service.Name, ip, service.UID, newService.UID)
+		// the port name is optional for a single port service
+		name := port.Name
+		if name == "" {
+			name = fmt.Sprintf("%s-%d", strings.ToLower(string(protocol)), port.Port)
 		}
-		serviceCopy := newService.DeepCopy()
-		updateServiceObject(serviceCopy, ip, primaryLabel)
-		_, err = l.localSvcClient.Update(serviceCopy)
-		return err
+		listeners = append(listeners, lbv1.Listener{
+			Name:        name,
+			Port:        port.Port,
+			Protocol:    protocol,
+			BackendPort: port.NodePort,
+		})
 	}
 
-	err := retry.RetryOnConflict(retry.DefaultBackoff, retryFunc)
+	return listeners
+}
+
+// setHealthCheck overwrites the health check of the load balancer per the service annotations on every update,
+// removing the annotations disables the health check.
+func (l *LoadBalancerManager) setHealthCheck(lb *lbv1.LoadBalancer, service *v1.Service) error {
+	healthCheck, err := getHealthCheck(service)
 	if err != nil {
-		return fmt.Errorf("failed to update %s service %s/%s with ip %s after retry, last error: %w", serviceType, service.Namespace, service.Name, ip, err)
+		l.recordEvent(service, v1.EventTypeWarning, eventReasonInvalidHealthCheck, "%s", err.Error())
+		return err
 	}
-
-	logrus.Infof("loadbalancer successfully gets %s service %s/%s to update ip %s", serviceType, service.Namespace, service.Name, ip)
+	lb.Spec.HealthCheck = healthCheck
 	return nil
 }
 
-func isPrimaryServiceUpdatedWithIP(service *v1.Service, lb *lbv1.LoadBalancer, ip, resolvedIface string) bool {
-	if resolvedIface != "" && service.Annotations[utils.KeyKubevipServiceInterface] != resolvedIface {
+// updateService applies the mutation to the latest service and retries on conflict, the service controller and the
+// handlers may update the service at the same time. It does nothing if the service is deleted or recreated, or the
+// mutation changes nothing.
+func (l *LoadBalancerManager) updateService(service *v1.Service, mutate func(serviceCopy *v1.Service)) error {
+	err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		latest, err := l.localSvcCache.Get(service.Namespace, service.Name)
+		if err != nil {
+			return err
+		}
+		if latest.UID != service.UID {
+			return nil
+		}
+		serviceCopy := latest.DeepCopy()
+		mutate(serviceCopy)
+		if equality.Semantic.DeepEqual(serviceCopy, latest) {
+			return nil
+		}
+		_, err = l.localSvcClient.Update(serviceCopy)
+		return err
+	})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func isPrimaryServiceUpdatedWithIP(announcer Announcer, service *v1.Service, lb *lbv1.LoadBalancer, ip, resolvedIface string) bool {
+	if resolvedIface != "" && announcer.Interface(service) != resolvedIface {
 		return false
 	}
 
+	// the ip contains the addresses of all IP families separated by comma, the lb allocates the first one
+	primaryIP, _, _ := strings.Cut(ip, ",")
+
 	// When there is no network annotation — we cannot determine the expected interface, so we only
 	// check the IP and let the serviceInterface annotation remain as-is.
-	return service.Annotations != nil &&
-		service.Annotations[utils.KeyKubevipLoadBalancerIP] == ip &&
-		lb.Status.Address == ip &&
+	return announcer.IsAnnounced(service, ip, primaryServiceLabelValue(service)) &&
+		lb.Status.Address == primaryIP &&
 		service.Labels != nil &&
 		service.Labels[utils.KeyPrimaryService] == ""
 }
 
-func (l *LoadBalancerManager) updatePrimaryServiceLoadBalancerIP(lbName string, service *v1.Service) error {
+// updatePrimaryServiceLoadBalancerIP writes the allocated IPs of the load balancers into the primary service, and
+// returns them in the order of the IP families. lbs holds the load balancers of flbs already got by the caller, the
+// missing ones are got here.
+func (l *LoadBalancerManager) updatePrimaryServiceLoadBalancerIP(flbs []familyLoadBalancer, lbs []*lbv1.LoadBalancer, service *v1.Service) ([]string, error) {
 	// Resolve the Linux interface from the network annotation for both DHCP and IPPool.
 	// checkNetworkBinding has already validated that the network is present in the NAD
 	// mapping, so an error here is unexpected but handled gracefully.
 	resolvedIface, err := l.resolveNetworkInterface(service)
 	if err != nil {
-		return fmt.Errorf("resolve interface for service %s/%s: %w", service.Namespace, service.Name, err)
+		return nil, fmt.Errorf("resolve interface for service %s/%s: %w", service.Namespace, service.Name, err)
 	}
 
-	object, ip, err := waitForIP(func() (runtime.Object, string, error) {
-		lb, err := l.lbClient.Get(l.namespace, lbName, metav1.GetOptions{})
+	var (
+		primaryLB *lbv1.LoadBalancer
+		ips       = make([]string, 0, len(flbs))
+	)
+	for i, flb := range flbs {
+		var lb *lbv1.LoadBalancer
+		if i < len(lbs) {
+			lb = lbs[i]
+		}
+		lb, ip, err := l.getAllocatedIP(flb, lb)
 		if err != nil {
-			return nil, "", fmt.Errorf("fail to get lb %w", err)
+			// the address of the second family is optional unless dual-stack is required, it's added to the service
+			// once allocated
+			if i > 0 && !isDualStackRequired(service) && goerrors.Is(err, errAllocationPending) {
+				logrus.Infof("service %s/%s is waiting for the %s address: %v", service.Namespace, service.Name, flb.family, err)
+				continue
+			}
+			if i > 0 && !isDualStackRequired(service) {
+				logrus.Warnf("service %s/%s prefers dual-stack but gets no %s address: %v", service.Namespace, service.Name, flb.family, err)
+				l.recordEvent(service, v1.EventTypeWarning, eventReasonIPFamilyNotAllocated,
+					"no %s address is allocated by load balancer %s/%s, fall back to single stack: %v", flb.family, l.namespace, flb.name, err)
+				continue
+			}
+			return nil, err
 		}
-		if lb.Status.AllocatedAddress.IP == "" {
-			// when Ready condition is false, the message has useful information
-			return nil, "", fmt.Errorf("ip is not allocated, mode: %s, message: %s", string(lb.Spec.IPAM), lbv1.LoadBalancerReady.GetMessage(lb))
+		if i == 0 {
+			primaryLB = lb
 		}
-		return lb, lb.Status.AllocatedAddress.IP, nil
-	})
-	if err != nil {
-		return err
+		ips = append(ips, ip)
 	}
+	ip := strings.Join(ips, ",")
 
-	lb := object.(*lbv1.LoadBalancer)
-
-	if isPrimaryServiceUpdatedWithIP(service, lb, ip, resolvedIface) {
-		return nil
+	if isPrimaryServiceUpdatedWithIP(l.announcer, service, primaryLB, ip, resolvedIface) {
+		return ips, nil
 	}
 
-	updatePrimaryServiceObject := func(serviceCopy *v1.Service, ip, primaryLabel string) {
+	// the service controller and OnLoadBalancerChanged may update the service at the same time, it has chance to hit
+	// the `IsConflict` error like
+	// "Operation cannot be fulfilled on services \"lb2\": the object has been modified; please apply your changes to the latest version and try again"
+	if err := l.updateService(service, func(serviceCopy *v1.Service) {
 		if serviceCopy.Labels != nil && serviceCopy.Labels[utils.KeyPrimaryService] != "" {
 			serviceCopy.Labels[utils.KeyPrimaryService] = ""
 		}
-		if serviceCopy.Annotations == nil {
-			serviceCopy.Annotations = make(map[string]string)
-		}
-		serviceCopy.Annotations[utils.KeyKubevipLoadBalancerIP] = ip
+		l.announcer.SetIPs(serviceCopy, ip, primaryServiceLabelValue(serviceCopy))
 		if resolvedIface != "" {
-			serviceCopy.Annotations[utils.KeyKubevipServiceInterface] = resolvedIface
+			l.announcer.SetInterface(serviceCopy, resolvedIface)
 		}
+	}); err != nil {
+		return nil, fmt.Errorf("failed to update primary service %s/%s with ip %s, error: %w", service.Namespace, service.Name, ip, err)
 	}
+	logrus.Infof("loadbalancer successfully gets primary service %s/%s to update ip %s", service.Namespace, service.Name, ip)
+	return ips, nil
+}
 
-	// the above waitForIP takes time, it has high chance to hit the `IsConflict` error like
-	// "Operation cannot be fulfilled on services \"lb2\": the object has been modified; please apply your changes to the latest version and try again"
-	return l.retryUpdateService(service, "primary", ip, "", updatePrimaryServiceObject)
+// getAllocatedIP returns the IP allocated by the load balancer and checks it's of the IP family, the load balancer is
+// got if lb is nil. errAllocationPending is returned if the IP is not allocated yet.
+func (l *LoadBalancerManager) getAllocatedIP(flb familyLoadBalancer, lb *lbv1.LoadBalancer) (*lbv1.LoadBalancer, string, error) {
+	if lb == nil {
+		var err error
+		if lb, err = l.lbClient.Get(l.namespace, flb.name, metav1.GetOptions{}); err != nil {
+			return nil, "", fmt.Errorf("fail to get lb %s/%s: %w", l.namespace, flb.name, err)
+		}
+	}
+	ip := lb.Status.AllocatedAddress.IP
+	if ip == "" {
+		// when Ready condition is false, the message has useful information
+		return nil, "", fmt.Errorf("%w, lb: %s/%s, mode: %s, message: %s", errAllocationPending, lb.Namespace, lb.Name,
+			string(lb.Spec.IPAM), lbv1.LoadBalancerReady.GetMessage(lb))
+	}
+
+	if flb.family != "" && ipFamilyOf(ip) != flb.family {
+		return nil, "", fmt.Errorf("%w: load balancer %s/%s requests %s but is allocated with %s, check the ip pool",
+			errIPFamilyMismatch, lb.Namespace, lb.Name, flb.family, ip)
+	}
+
+	return lb, ip, nil
 }
 
-func isSecondaryServiceUpdatedWithPrimary(primary, secondary *v1.Service, ip, labelValue string) bool {
+func isSecondaryServiceUpdatedWithPrimary(announcer Announcer, primary, secondary *v1.Service, ip, labelValue string) bool {
 
 	// old svc doesn't have network annotation.
 	if hasNetworkAnnotation(primary) {
@@ -475,9 +727,8 @@ func isSecondaryServiceUpdatedWithPrimary(primary, secondary *v1.Service, ip, la
 		}
 	}
 
-	return secondary.Annotations != nil &&
-		secondary.Annotations[utils.KeyKubevipLoadBalancerIP] == ip &&
-		secondary.Annotations[utils.KeyKubevipServiceInterface] == "" &&
+	return announcer.IsAnnounced(secondary, ip, labelValue) &&
+		announcer.Interface(secondary) == "" &&
 		secondary.Annotations[utils.KeyIPAM] == "" &&
 		secondary.Labels != nil &&
 		secondary.Labels[utils.KeyPrimaryService] == labelValue
@@ -485,11 +736,11 @@ func isSecondaryServiceUpdatedWithPrimary(primary, secondary *v1.Service, ip, la
 
 func (l *LoadBalancerManager) updateSecondaryServiceLoadBalancerIP(ip string, primary, secondary *v1.Service) error {
 	labelValue := primaryServiceLabelValue(primary)
-	if isSecondaryServiceUpdatedWithPrimary(primary, secondary, ip, labelValue) {
+	if isSecondaryServiceUpdatedWithPrimary(l.announcer, primary, secondary, ip, labelValue) {
 		return nil
 	}
 
-	updateSecondaryServiceObject := func(secondaryCopy *v1.Service, ip, primaryLabel string) {
+	err := l.updateService(secondary, func(secondaryCopy *v1.Service) {
 		if secondaryCopy.Labels == nil {
 			secondaryCopy.Labels = make(map[string]string)
 		}
@@ -497,20 +748,25 @@ func (l *LoadBalancerManager) updateSecondaryServiceLoadBalancerIP(ip string, pr
 			secondaryCopy.Annotations = make(map[string]string)
 		}
 		// add a label for easy filtering
-		secondaryCopy.Labels[utils.KeyPrimaryService] = primaryLabel
-		// update the annotations and kube-vip will update the service status load balancer
-		secondaryCopy.Annotations[utils.KeyKubevipLoadBalancerIP] = ip
+		secondaryCopy.Labels[utils.KeyPrimaryService] = labelValue
+		// update the annotations and the announcer, e.g. kube-vip, will update the service status load balancer
+		l.announcer.SetIPs(secondaryCopy, ip, labelValue)
 
 		// old svc doesn't have network annotation.
 		if hasNetworkAnnotation(primary) {
 			secondaryCopy.Annotations[utils.KeyNetwork] = primary.Annotations[utils.KeyNetwork]
 		}
 
-		delete(secondaryCopy.Annotations, utils.KeyKubevipServiceInterface)
+		// the interface is announced by the primary service
+		l.announcer.SetInterface(secondaryCopy, "")
 		delete(secondaryCopy.Annotations, utils.KeyIPAM)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update secondary service %s/%s with ip %s, error: %w", secondary.Namespace, secondary.Name, ip, err)
 	}
 
-	return l.retryUpdateService(secondary, "secondary", ip, labelValue, updateSecondaryServiceObject)
+	logrus.Infof("loadbalancer successfully gets secondary service %s/%s to update ip %s", secondary.Namespace, secondary.Name, ip)
+	return nil
 }
 
 func hasNetworkAnnotation(service *v1.Service) bool {
@@ -521,13 +777,10 @@ func IsNetworkChanged(svc *v1.Service, lb *lbv1.LoadBalancer) bool {
 	return svc.Annotations[utils.KeyNetwork] != lb.Annotations[utils.AnnotationKeyNetworkOnLB]
 }
 
-func (l *LoadBalancerManager) checkNetworkChanged(svc *v1.Service, lbName string, secondary bool) error {
-	lb, err := l.lbClient.Get(l.namespace, lbName, metav1.GetOptions{})
-	if err != nil && !errors.IsNotFound(err) {
-		return err
-	}
-
-	if lb == nil || lb.Name == "" {
+// checkNetworkChanged rejects changing the network annotation of the service of an existing load balancer, lb is nil if
+// it doesn't exist.
+func checkNetworkChanged(svc *v1.Service, lb *lbv1.LoadBalancer, secondary bool) error {
+	if lb == nil {
 		return nil
 	}
 
@@ -554,64 +807,52 @@ func (l *LoadBalancerManager) deleteLoadBalancer(clusterName string, service *v1
 	if err := l.checkSecondaryServicesBeforeDeleted(service); err != nil {
 		return fmt.Errorf("could not delete load balancer for service %s/%s: %w", service.Namespace, service.Name, err)
 	}
-
-	name := loadBalancerName(clusterName, service.Namespace, service.Name, string(service.UID))
-	_, err := l.lbClient.Get(l.namespace, name, metav1.GetOptions{})
-	if err != nil && !errors.IsNotFound(err) {
+	if err := l.syncSecondaryServicesFinalizer(service, ""); err != nil {
 		return err
 	}
-	if err == nil {
-		return l.lbClient.Delete(l.namespace, name, &metav1.DeleteOptions{})
+
+	for _, name := range allLoadBalancerNames(clusterName, service) {
+		if err := l.deleteLoadBalancerByName(name, service); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func waitForIP(callback func() (runtime.Object, string, error)) (runtime.Object, string, error) {
-	var (
-		err    error
-		object runtime.Object
-		ip     string
-	)
-	for i := 0; i < retryTimes; i++ {
-		object, ip, err = callback()
-		if err == nil {
-			return object, ip, nil
+// deleteFamilyLoadBalancers deletes the load balancers allocating the address of the second IP family. The families
+// of the service may have been changed, so both families are checked.
+func (l *LoadBalancerManager) deleteFamilyLoadBalancers(clusterName string, service *v1.Service) error {
+	primaryFamilyName := getFamilyLoadBalancers(clusterName, service)[0].name
+	for _, name := range allLoadBalancerNames(clusterName, service) {
+		if name == primaryFamilyName {
+			continue
+		}
+		if err := l.deleteLoadBalancerByName(name, service); err != nil {
+			return err
 		}
-		time.Sleep(retryInterval)
 	}
-
-	return nil, "", fmt.Errorf("timeout waiting for IP address, last error:%w", err)
+	return nil
 }
 
-func (l *LoadBalancerManager) checkPortOverlap(primary, secondary *v1.Service) error {
-	portMap := make(map[int32]bool)
-	for _, port := range secondary.Spec.Ports {
-		portMap[port.Port] = true
+// deleteLoadBalancerByName deletes the load balancer unless it's owned by another service, e.g. the load balancer has
+// been handed over to a promoted secondary service.
+func (l *LoadBalancerManager) deleteLoadBalancerByName(name string, service *v1.Service) error {
+	lb, err := l.lbClient.Get(l.namespace, name, metav1.GetOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
 	}
-	// TODO: Listing services filtered by primary service label could cause concurrency problem because the primary service
-	// label is added after this function is called. Some eligible services may not be listed.
-	svcs, err := l.localSvcCache.List(metav1.NamespaceAll, labels.Set(map[string]string{
-		utils.KeyPrimaryService: primaryServiceLabelValue(primary),
-	}).AsSelector())
 	if err != nil {
-		return fmt.Errorf("list service failed: %w", err)
+		return nil
 	}
-	svcs = append(svcs, primary)
 
-	for _, svc := range svcs {
-		// ignore itself
-		if svc.UID == secondary.UID {
-			continue
-		}
-		for _, port := range svc.Spec.Ports {
-			if portMap[port.Port] {
-				return fmt.Errorf("port %d has been used in service %s/%s", port.Port, svc.Namespace, svc.Name)
-			}
-		}
+	if uid := lb.Annotations[utils.AnnotationKeyServiceUIDOnLB]; uid != "" && uid != string(service.UID) {
+		logrus.Infof("skip deleting lb %s/%s of service %s/%s, it's owned by service %s/%s now", lb.Namespace, lb.Name,
+			service.Namespace, service.Name, lb.Labels[utils.LBServiceNamespaceKey], lb.Labels[utils.LBServiceNameKey])
+		return nil
 	}
 
-	return nil
+	return l.lbClient.Delete(l.namespace, name, &metav1.DeleteOptions{})
 }
 
 func (l *LoadBalancerManager) checkSecondaryServicesBeforeDeleted(primary *v1.Service) error {
@@ -619,14 +860,15 @@ func (l *LoadBalancerManager) checkSecondaryServicesBeforeDeleted(primary *v1.Se
 
 	// Listing services filtered by primary service label could cause concurrency problem because there may be secondary
 	// services added after this function is called and before the service is deleted.
-	svcs, err := l.localSvcCache.List(metav1.NamespaceAll, labels.Set(map[string]string{
-		utils.KeyPrimaryService: primaryServiceLabelValue(primary),
-	}).AsSelector())
+	svcs, err := l.listSecondaryServices(primary)
 	if err != nil {
 		return err
 	}
 
 	if len(svcs) > 0 {
+		if primary.DeletionTimestamp != nil {
+			l.recordDeletionBlocked(primary, svcs)
+		}
 		svcNames := make([]string, 0, len(svcs))
 		for _, svc := range svcs {
 			svcNames = append(svcNames, svc.Namespace+"/"+svc.Name)
@@ -637,6 +879,12 @@ func (l *LoadBalancerManager) checkSecondaryServicesBeforeDeleted(primary *v1.Se
 	return nil
 }
 
+func (l *LoadBalancerManager) listSecondaryServices(primary *v1.Service) ([]*v1.Service, error) {
+	return l.localSvcCache.List(metav1.NamespaceAll, labels.Set(map[string]string{
+		utils.KeyPrimaryService: primaryServiceLabelValue(primary),
+	}).AsSelector())
+}
+
 func primaryServiceLabelValue(svc *v1.Service) string {
 	return svc.Namespace + "." + svc.Name
 }
@@ -0,0 +1,163 @@
+package ccm
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	lbv1 "github.com/harvester/harvester-load-balancer/pkg/apis/loadbalancer.harvesterhci.io/v1beta1"
+	ctllbv1 "github.com/harvester/harvester-load-balancer/pkg/generated/controllers/loadbalancer.harvesterhci.io/v1beta1"
+	wranglecorev1 "github.com/rancher/wrangler/v3/pkg/generated/controllers/core/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+
+	utils "github.com/harvester/harvester-cloud-provider/pkg/utils"
+)
+
+// loadBalancerGC deletes the Harvester load balancers whose guest services no longer exist. They are left behind if
+// the cloud provider is down while the services are deleted, and keep the IPs allocated from the pools.
+type loadBalancerGC struct {
+	lbClient       ctllbv1.LoadBalancerClient
+	localSvcClient wranglecorev1.ServiceClient
+	localSvcCache  wranglecorev1.ServiceCache
+	namespace      string
+	clusterName    string
+	gracePeriod    time.Duration
+	dryRun         bool
+	// serviceSynced reports whether the service informer has synced, a service missing from the cache before that
+	// isn't deleted
+	serviceSynced cache.InformerSynced
+
+	// orphans records the time a load balancer is found orphaned for the first time
+	orphans map[string]time.Time
+}
+
+// run collects the orphaned load balancers every interval. The first collection waits for the service cache to sync.
+func (g *loadBalancerGC) run(ctx context.Context, interval time.Duration) {
+	if g.clusterName == "" || g.clusterName == utils.DefaultGuestClusterName {
+		logrus.Warnf("load balancer garbage collection is disabled as the --%s is empty or default, the load balancers of other guest clusters can't be distinguished",
+			utils.FlagClusterName)
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"namespace":    g.namespace,
+		"cluster name": g.clusterName,
+		"interval":     interval,
+		"grace period": g.gracePeriod,
+		"dry run":      g.dryRun,
+	}).Info("start garbage collecting orphaned load balancers")
+
+	if !cache.WaitForCacheSync(ctx.Done(), g.serviceSynced) {
+		logrus.Warn("load balancer garbage collection is stopped before the service cache is synced")
+		return
+	}
+
+	wait.UntilWithContext(ctx, func(_ context.Context) {
+		if err := g.collect(time.Now()); err != nil {
+			logrus.Warnf("garbage collecting orphaned load balancers failed: %v", err)
+		}
+	}, interval)
+}
+
+// collect deletes the load balancers which have been orphaned for the grace period.
+func (g *loadBalancerGC) collect(now time.Time) error {
+	lbs, err := g.lbClient.List(g.namespace, metav1.ListOptions{
+		LabelSelector: labels.Set{utils.LBClusterNameKey: g.clusterName}.String(),
+	})
+	if err != nil {
+		return fmt.Errorf("list load balancers of cluster %s failed: %w", g.clusterName, err)
+	}
+
+	orphans := make(map[string]time.Time)
+	for i := range lbs.Items {
+		lb := &lbs.Items[i]
+		if lb.DeletionTimestamp != nil {
+			continue
+		}
+
+		orphaned, err := g.isOrphaned(lb)
+		if err != nil {
+			logrus.Warnf("check owner of load balancer %s/%s failed: %v", lb.Namespace, lb.Name, err)
+			continue
+		}
+		if !orphaned {
+			continue
+		}
+
+		since, ok := g.orphans[lb.Name]
+		if !ok {
+			since = now
+		}
+		if now.Sub(since) < g.gracePeriod {
+			orphans[lb.Name] = since
+			continue
+		}
+
+		logger := logrus.WithFields(logrus.Fields{
+			"loadbalancer": lb.Namespace + "/" + lb.Name,
+			"service":      lb.Labels[utils.LBServiceNamespaceKey] + "/" + lb.Labels[utils.LBServiceNameKey],
+			"ip":           lb.Status.AllocatedAddress.IP,
+			"orphaned at":  since,
+		})
+		if g.dryRun {
+			logger.Info("dry run: orphaned load balancer would be deleted")
+			orphans[lb.Name] = since
+			continue
+		}
+		if err := g.lbClient.Delete(lb.Namespace, lb.Name, &metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			logger.Warnf("delete orphaned load balancer failed: %v", err)
+			orphans[lb.Name] = since
+			continue
+		}
+		logger.Info("orphaned load balancer is deleted")
+	}
+	// the load balancers which are deleted or owned again are forgotten
+	g.orphans = orphans
+
+	return nil
+}
+
+// isOrphaned reports whether the guest service of the load balancer is gone. The cache is double-checked by the client
+// before a load balancer is reported as orphaned.
+func (g *loadBalancerGC) isOrphaned(lb *lbv1.LoadBalancer) (bool, error) {
+	namespace, name := lb.Labels[utils.LBServiceNamespaceKey], lb.Labels[utils.LBServiceNameKey]
+	if namespace == "" || name == "" {
+		return false, nil
+	}
+
+	service, err := g.localSvcCache.Get(namespace, name)
+	if err != nil && !errors.IsNotFound(err) {
+		return false, err
+	}
+	if err == nil && g.isOwner(service, lb) {
+		return false, nil
+	}
+
+	service, err = g.localSvcClient.Get(namespace, name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return !g.isOwner(service, lb), nil
+}
+
+// isOwner compares the UID of the service with the one recorded on the load balancer. The load balancers created
+// before the UID is recorded are compared by the names derived from the UID.
+func (g *loadBalancerGC) isOwner(service *v1.Service, lb *lbv1.LoadBalancer) bool {
+	if uid, ok := lb.Annotations[utils.AnnotationKeyServiceUIDOnLB]; ok {
+		return uid == string(service.UID)
+	}
+
+	return slices.Contains(allLoadBalancerNames(g.clusterName, service), lb.Name)
+}
@@ -0,0 +1,96 @@
+package ccm
+
+import (
+	"context"
+	goerrors "errors"
+	"slices"
+
+	"github.com/sirupsen/logrus"
+
+	lbv1 "github.com/harvester/harvester-load-balancer/pkg/apis/loadbalancer.harvesterhci.io/v1beta1"
+	ctllbv1 "github.com/harvester/harvester-load-balancer/pkg/generated/controllers/loadbalancer.harvesterhci.io/v1beta1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+
+	utils "github.com/harvester/harvester-cloud-provider/pkg/utils"
+)
+
+const (
+	lbControllerName = "harvester-cloudprovider-loadbalancer-allocation"
+)
+
+// registerLoadBalancerHandler watches the Harvester load balancers in the namespace of the cloud provider, the factory
+// of the load balancers is limited to the namespace.
+func (l *LoadBalancerManager) registerLoadBalancerHandler(ctx context.Context, lbs ctllbv1.LoadBalancerController) {
+	logrus.WithFields(logrus.Fields{
+		"controller": lbControllerName,
+		"namespace":  l.namespace,
+	}).Info("start watching load balancer")
+	lbs.OnChange(ctx, lbControllerName, l.OnLoadBalancerChanged)
+}
+
+// OnLoadBalancerChanged sets the allocated IP into the guest service as soon as it is allocated by the Harvester load
+// balancer, so that EnsureLoadBalancer doesn't have to wait for it. Updating the kube-vip annotation requeues the
+// service in the service controller. The conditions and the backend servers of the load balancer are copied onto the
+// service as well.
+func (l *LoadBalancerManager) OnLoadBalancerChanged(_ string, lb *lbv1.LoadBalancer) (*lbv1.LoadBalancer, error) {
+	if lb == nil || lb.DeletionTimestamp != nil {
+		return lb, nil
+	}
+
+	service, err := l.localSvcCache.Get(lb.Labels[utils.LBServiceNamespaceKey], lb.Labels[utils.LBServiceNameKey])
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return lb, nil
+		}
+		return lb, err
+	}
+	if service.DeletionTimestamp != nil || service.Spec.Type != v1.ServiceTypeLoadBalancer || service.Annotations[utils.KeyPrimaryService] != "" {
+		return lb, nil
+	}
+
+	// The name of the load balancer is derived from the UID of the service, it doesn't match if the load balancer
+	// belongs to another guest cluster or a deleted service with the same name.
+	clusterName := lb.Labels[utils.LBClusterNameKey]
+	if !slices.Contains(allLoadBalancerNames(clusterName, service), lb.Name) {
+		return lb, nil
+	}
+	flbs := getFamilyLoadBalancers(clusterName, service)
+	i := slices.IndexFunc(flbs, func(flb familyLoadBalancer) bool { return flb.name == lb.Name })
+	if i < 0 && isNetworkMigrationAllowed(service) {
+		// the load balancer on the new network of a migration, switching the service to its address resumes the
+		// migration in the service controller
+		flbs = migrationTargets(clusterName, service, flbs)
+		i = slices.IndexFunc(flbs, func(flb familyLoadBalancer) bool { return flb.name == lb.Name })
+	}
+	if i < 0 {
+		return lb, nil
+	}
+
+	if err := l.syncServiceConditions(service, flbs[i], lb); err != nil {
+		return lb, err
+	}
+	// the backend servers of the load balancers of both families are the same
+	if i == 0 {
+		if err := l.syncBackendServers(service, lb); err != nil {
+			return lb, err
+		}
+	}
+
+	if lb.Status.AllocatedAddress.IP == "" {
+		return lb, nil
+	}
+
+	// the load balancer of the other family is got
+	lbs := make([]*lbv1.LoadBalancer, len(flbs))
+	lbs[i] = lb
+	if _, err := l.updatePrimaryServiceLoadBalancerIP(flbs, lbs, service); err != nil {
+		// the load balancer of the other family will trigger the update once it's allocated
+		if goerrors.Is(err, errAllocationPending) {
+			return lb, nil
+		}
+		return lb, err
+	}
+
+	return lb, nil
+}
@@ -1,17 +1,26 @@
 package ccm
 
 import (
+	"context"
 	"encoding/json"
+	goerrors "errors"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	lbv1 "github.com/harvester/harvester-load-balancer/pkg/apis/loadbalancer.harvesterhci.io/v1beta1"
 	pkgctllb "github.com/harvester/harvester-load-balancer/pkg/controller/loadbalancer"
 	"github.com/sirupsen/logrus/hooks/test"
 	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/cloud-provider/api"
 
 	cfg "github.com/harvester/harvester-cloud-provider/pkg/config"
 	utils "github.com/harvester/harvester-cloud-provider/pkg/utils"
@@ -264,6 +273,27 @@ func Test_isPrimaryServiceUpdatedWithIP(t *testing.T) {
 			resolvedIface: "enp1s0",
 			want:          true,
 		},
+		{
+			// dual-stack: the lb allocates the first address only
+			name: "fully_updated_dual_stack",
+			annotations: map[string]string{
+				utils.KeyKubevipLoadBalancerIP: ip + ",fd00::57",
+			},
+			labels:    map[string]string{utils.KeyPrimaryService: ""},
+			lbAddress: ip,
+			ip:        ip + ",fd00::57",
+			want:      true,
+		},
+		{
+			name: "dual_stack_second_family_missing",
+			annotations: map[string]string{
+				utils.KeyKubevipLoadBalancerIP: ip,
+			},
+			labels:    map[string]string{utils.KeyPrimaryService: ""},
+			lbAddress: ip,
+			ip:        ip + ",fd00::57",
+			want:      false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -279,7 +309,7 @@ func Test_isPrimaryServiceUpdatedWithIP(t *testing.T) {
 					Address: tt.lbAddress,
 				},
 			}
-			got := isPrimaryServiceUpdatedWithIP(svc, lb, tt.ip, tt.resolvedIface)
+			got := isPrimaryServiceUpdatedWithIP(announcers[utils.VIPAnnouncerKubeVip], svc, lb, tt.ip, tt.resolvedIface)
 			if got != tt.want {
 				t.Errorf("isPrimaryServiceUpdatedWithIP() = %v, want %v", got, tt.want)
 			}
@@ -425,7 +455,7 @@ func Test_isSecondaryServiceUpdatedWithPrimary(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			svc := newServiceWithAnnotations(tt.annotations, tt.labels)
 			primary := newServiceWithAnnotations(nil, nil)
-			got := isSecondaryServiceUpdatedWithPrimary(primary, svc, ip, labelValue)
+			got := isSecondaryServiceUpdatedWithPrimary(announcers[utils.VIPAnnouncerKubeVip], primary, svc, ip, labelValue)
 			if got != tt.want {
 				t.Errorf("isSecondaryServiceUpdatedWithPrimary() = %v, want %v", got, tt.want)
 			}
@@ -526,3 +556,1646 @@ func Test_resolveNetworkInterface(t *testing.T) {
 		})
 	}
 }
+
+func Test_getHealthCheck(t *testing.T) {
+	ports := []v1.ServicePort{
+		{Name: "http", Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP},
+		{Name: "https", Port: 443, Protocol: v1.ProtocolTCP},
+	}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		local       bool
+		want        *lbv1.HealthCheck
+		wantErr     bool
+	}{
+		{
+			name:        "no health check port: health check disabled",
+			annotations: map[string]string{utils.KeyHealthCheckSuccessThreshold: "2"},
+			want:        nil,
+		},
+		{
+			name:    "external traffic policy Local without health check port",
+			local:   true,
+			wantErr: true,
+		},
+		{
+			name:        "external traffic policy Local of workload type vm without health check port",
+			annotations: map[string]string{utils.KeyWorkloadType: string(lbv1.VM)},
+			local:       true,
+			want:        nil,
+		},
+		{
+			name:        "only port: defaults applied and node port probed",
+			annotations: map[string]string{utils.KeyHealthCheckPort: "80"},
+			want: &lbv1.HealthCheck{
+				Port:             30080,
+				SuccessThreshold: utils.DefaultHealthCheckSuccessThreshold,
+				FailureThreshold: utils.DefaultHealthCheckFailureThreshold,
+				PeriodSeconds:    utils.DefaultHealthCheckPeriodSeconds,
+				TimeoutSeconds:   utils.DefaultHealthCheckTimeoutSeconds,
+			},
+		},
+		{
+			name: "all annotations",
+			annotations: map[string]string{
+				utils.KeyHealthCheckPort:             "80",
+				utils.KeyHealthCheckSuccessThreshold: "2",
+				utils.KeyHealthCheckFailureThreshold: "4",
+				utils.KeyHealthCheckPeriodSeconds:    "10",
+				utils.KeyHealthCheckTimeoutSeconds:   "6",
+			},
+			want: &lbv1.HealthCheck{Port: 30080, SuccessThreshold: 2, FailureThreshold: 4, PeriodSeconds: 10, TimeoutSeconds: 6},
+		},
+		{
+			name:        "node port: probed as is for backward compatibility",
+			annotations: map[string]string{utils.KeyHealthCheckPort: "30080"},
+			want: &lbv1.HealthCheck{
+				Port:             30080,
+				SuccessThreshold: utils.DefaultHealthCheckSuccessThreshold,
+				FailureThreshold: utils.DefaultHealthCheckFailureThreshold,
+				PeriodSeconds:    utils.DefaultHealthCheckPeriodSeconds,
+				TimeoutSeconds:   utils.DefaultHealthCheckTimeoutSeconds,
+			},
+		},
+		{
+			name:        "port is not a service port",
+			annotations: map[string]string{utils.KeyHealthCheckPort: "8080"},
+			wantErr:     true,
+		},
+		{
+			name:        "port has no node port",
+			annotations: map[string]string{utils.KeyHealthCheckPort: "443"},
+			wantErr:     true,
+		},
+		{
+			name:        "malformed port",
+			annotations: map[string]string{utils.KeyHealthCheckPort: "http"},
+			wantErr:     true,
+		},
+		{
+			name: "zero threshold",
+			annotations: map[string]string{
+				utils.KeyHealthCheckPort:             "80",
+				utils.KeyHealthCheckFailureThreshold: "0",
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative period",
+			annotations: map[string]string{
+				utils.KeyHealthCheckPort:          "80",
+				utils.KeyHealthCheckPeriodSeconds: "-5",
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newServiceWithAnnotations(tt.annotations, nil)
+			svc.Spec.Ports = ports
+			if tt.local {
+				svc.Spec.ExternalTrafficPolicy = v1.ServiceExternalTrafficPolicyLocal
+			}
+			got, err := getHealthCheck(svc)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getHealthCheck() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("getHealthCheck() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_getListeners(t *testing.T) {
+	tests := []struct {
+		name  string
+		ports []v1.ServicePort
+		want  []lbv1.Listener
+	}{
+		{
+			name: "no ports",
+			want: nil,
+		},
+		{
+			name: "named ports with all protocols",
+			ports: []v1.ServicePort{
+				{Name: "dns-tcp", Port: 53, NodePort: 30053, Protocol: v1.ProtocolTCP},
+				{Name: "dns-udp", Port: 53, NodePort: 31053, Protocol: v1.ProtocolUDP},
+				{Name: "sctp", Port: 9000, NodePort: 32000, Protocol: v1.ProtocolSCTP},
+			},
+			want: []lbv1.Listener{
+				{Name: "dns-tcp", Port: 53, Protocol: v1.ProtocolTCP, BackendPort: 30053},
+				{Name: "dns-udp", Port: 53, Protocol: v1.ProtocolUDP, BackendPort: 31053},
+				{Name: "sctp", Port: 9000, Protocol: v1.ProtocolSCTP, BackendPort: 32000},
+			},
+		},
+		{
+			name: "unnamed port and default protocol",
+			ports: []v1.ServicePort{
+				{Port: 80, NodePort: 30080},
+			},
+			want: []lbv1.Listener{
+				{Name: "tcp-80", Port: 80, Protocol: v1.ProtocolTCP, BackendPort: 30080},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newServiceWithAnnotations(nil, nil)
+			svc.Spec.Ports = tt.ports
+			if diff := cmp.Diff(tt.want, getListeners(svc)); diff != "" {
+				t.Errorf("getListeners() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_validateIPPool(t *testing.T) {
+	const (
+		clusterName = "gc1"
+		namespace   = "default"
+		network     = "default/vlan100"
+	)
+
+	newPool := func(network string, scope ...lbv1.Tuple) *lbv1.IPPool {
+		return &lbv1.IPPool{
+			ObjectMeta: metav1.ObjectMeta{Name: "pool1"},
+			Spec: lbv1.IPPoolSpec{
+				Selector: lbv1.Selector{Network: network, Scope: scope},
+			},
+		}
+	}
+
+	tests := []struct {
+		name        string
+		pool        *lbv1.IPPool
+		annotations map[string]string
+		wantErr     bool
+	}{
+		{
+			name:        "network and guest cluster matched",
+			pool:        newPool(network, lbv1.Tuple{GuestCluster: clusterName, Namespace: namespace}),
+			annotations: map[string]string{utils.KeyNetwork: network},
+		},
+		{
+			name:        "wildcard scope",
+			pool:        newPool(network, lbv1.Tuple{GuestCluster: "*", Namespace: "*", Project: "*"}),
+			annotations: map[string]string{utils.KeyNetwork: network},
+		},
+		{
+			name:        "empty guest cluster in scope matches any cluster",
+			pool:        newPool(network, lbv1.Tuple{Namespace: namespace}),
+			annotations: map[string]string{utils.KeyNetwork: network},
+		},
+		{
+			name: "global pool",
+			pool: func() *lbv1.IPPool {
+				pool := newPool("")
+				pool.Labels = map[string]string{"loadbalancer.harvesterhci.io/global-ip-pool": "true"}
+				return pool
+			}(),
+			annotations: map[string]string{utils.KeyNetwork: network},
+		},
+		{
+			name:        "network mismatched",
+			pool:        newPool("default/vlan200", lbv1.Tuple{GuestCluster: "*", Namespace: "*"}),
+			annotations: map[string]string{utils.KeyNetwork: network},
+			wantErr:     true,
+		},
+		{
+			name:        "service without network annotation",
+			pool:        newPool(network, lbv1.Tuple{GuestCluster: "*", Namespace: "*"}),
+			annotations: map[string]string{},
+			wantErr:     true,
+		},
+		{
+			name:        "scope of another guest cluster",
+			pool:        newPool(network, lbv1.Tuple{GuestCluster: "gc2", Namespace: namespace}),
+			annotations: map[string]string{utils.KeyNetwork: network},
+			wantErr:     true,
+		},
+		{
+			name:        "scope of another namespace",
+			pool:        newPool(network, lbv1.Tuple{GuestCluster: clusterName, Namespace: "other"}),
+			annotations: map[string]string{utils.KeyNetwork: network},
+			wantErr:     true,
+		},
+		{
+			name:        "namespace annotation overrides the load balancer namespace",
+			pool:        newPool(network, lbv1.Tuple{GuestCluster: clusterName, Namespace: "other"}),
+			annotations: map[string]string{utils.KeyNetwork: network, utils.KeyNamespace: "other"},
+		},
+		{
+			name:        "no scope",
+			pool:        newPool(network),
+			annotations: map[string]string{utils.KeyNetwork: network},
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newServiceWithAnnotations(tt.annotations, nil)
+			err := validateIPPool(tt.pool, svc, clusterName, namespace)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateIPPool() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_checkRequestedIP(t *testing.T) {
+	tests := []struct {
+		name           string
+		annotations    map[string]string
+		loadBalancerIP string
+		wantErr        bool
+	}{
+		{name: "nothing requested"},
+		{name: "annotation", annotations: map[string]string{utils.KeyRequestedIP: "192.168.100.20"}, wantErr: true},
+		{name: "spec.loadBalancerIP", loadBalancerIP: "192.168.100.20", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newServiceWithAnnotations(tt.annotations, nil)
+			svc.Spec.LoadBalancerIP = tt.loadBalancerIP
+			l := &LoadBalancerManager{}
+			if err := l.checkRequestedIP(svc); (err != nil) != tt.wantErr {
+				t.Errorf("checkRequestedIP() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_getFamilyLoadBalancers(t *testing.T) {
+	singleStack := v1.IPFamilyPolicySingleStack
+	preferDualStack := v1.IPFamilyPolicyPreferDualStack
+	requireDualStack := v1.IPFamilyPolicyRequireDualStack
+
+	tests := []struct {
+		name           string
+		ipPool         string
+		ipFamilies     []v1.IPFamily
+		ipFamilyPolicy *v1.IPFamilyPolicy
+		wantFamilies   []v1.IPFamily
+	}{
+		{name: "no ip families", wantFamilies: []v1.IPFamily{""}},
+		{
+			name:           "single stack",
+			ipFamilies:     []v1.IPFamily{v1.IPv6Protocol},
+			ipFamilyPolicy: &singleStack,
+			wantFamilies:   []v1.IPFamily{v1.IPv6Protocol},
+		},
+		{
+			name:           "prefer dual-stack on single stack cluster",
+			ipFamilies:     []v1.IPFamily{v1.IPv4Protocol},
+			ipFamilyPolicy: &preferDualStack,
+			wantFamilies:   []v1.IPFamily{v1.IPv4Protocol},
+		},
+		{
+			name:           "prefer dual-stack",
+			ipPool:         "pool-v4,pool-v6",
+			ipFamilies:     []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+			ipFamilyPolicy: &preferDualStack,
+			wantFamilies:   []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+		},
+		{
+			name:           "prefer dual-stack without a pool per family",
+			ipPool:         "pool-v4",
+			ipFamilies:     []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+			ipFamilyPolicy: &preferDualStack,
+			wantFamilies:   []v1.IPFamily{v1.IPv4Protocol},
+		},
+		{
+			name:           "require dual-stack ipv6 first",
+			ipFamilies:     []v1.IPFamily{v1.IPv6Protocol, v1.IPv4Protocol},
+			ipFamilyPolicy: &requireDualStack,
+			wantFamilies:   []v1.IPFamily{v1.IPv6Protocol, v1.IPv4Protocol},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newServiceWithAnnotations(map[string]string{utils.KeyIPPool: tt.ipPool}, nil)
+			svc.Spec.IPFamilies = tt.ipFamilies
+			svc.Spec.IPFamilyPolicy = tt.ipFamilyPolicy
+			flbs := getFamilyLoadBalancers("test", svc)
+			if len(flbs) != len(tt.wantFamilies) {
+				t.Fatalf("getFamilyLoadBalancers() returns %d load balancers, want %d", len(flbs), len(tt.wantFamilies))
+			}
+			// the first one keeps the name of the single stack load balancer
+			if want := loadBalancerName("test", svc.Namespace, svc.Name, string(svc.UID)); flbs[0].name != want {
+				t.Errorf("name of the first load balancer = %s, want %s", flbs[0].name, want)
+			}
+			for i, flb := range flbs {
+				if flb.family != tt.wantFamilies[i] || flb.index != i {
+					t.Errorf("load balancer %d = %+v, want family %s", i, flb, tt.wantFamilies[i])
+				}
+			}
+			if len(flbs) == 2 && flbs[0].name == flbs[1].name {
+				t.Errorf("load balancers of both families have the same name %s", flbs[0].name)
+			}
+		})
+	}
+}
+
+func Test_getIPPool(t *testing.T) {
+	svc := newServiceWithAnnotations(map[string]string{utils.KeyIPPool: "pool-v4, pool-v6"}, nil)
+	for index, want := range []string{"pool-v4", "pool-v6", ""} {
+		if got := getIPPool(svc, index); got != want {
+			t.Errorf("getIPPool(%d) = %s, want %s", index, got, want)
+		}
+	}
+}
+
+func Test_requireDualStackWithoutFamilyIPPools(t *testing.T) {
+	requireDualStack := v1.IPFamilyPolicyRequireDualStack
+	svc := newServiceWithAnnotations(map[string]string{utils.KeyIPPool: "pool-v4"}, nil)
+	svc.Spec.IPFamilies = []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol}
+	svc.Spec.IPFamilyPolicy = &requireDualStack
+	l := newFakeLoadBalancerManager(fakeclients.NewLoadBalancerClient(), fakeclients.NewServiceClient(svc))
+
+	flbs := getFamilyLoadBalancers("test", svc)
+	if len(flbs) != 2 {
+		t.Fatalf("getFamilyLoadBalancers() returns %d load balancers, want 2", len(flbs))
+	}
+	if err := l.checkAllocationRequest(svc, "test", flbs[1], nil); err == nil {
+		t.Errorf("checkAllocationRequest() of the family without a pool succeeded")
+	}
+}
+
+func Test_upgradeToDualStack(t *testing.T) {
+	const clusterName = "test"
+	svc := newLoadBalancerService()
+	lbClient := fakeclients.NewLoadBalancerClient()
+	l := newFakeLoadBalancerManager(lbClient, fakeclients.NewServiceClient(svc))
+
+	// the single stack load balancer is created without a pool
+	var retryErr *api.RetryError
+	if _, err := l.EnsureLoadBalancer(context.Background(), clusterName, svc, nil); !goerrors.As(err, &retryErr) {
+		t.Fatalf("EnsureLoadBalancer() error = %v, want a retry error", err)
+	}
+
+	// a PreferDualStack service without a pool per family stays single stack with an event
+	preferDualStack := v1.IPFamilyPolicyPreferDualStack
+	svc.Spec.IPFamilies = []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol}
+	svc.Spec.IPFamilyPolicy = &preferDualStack
+	recorder := record.NewFakeRecorder(10)
+	l.recorder = recorder
+	if _, err := l.EnsureLoadBalancer(context.Background(), clusterName, svc, nil); !goerrors.As(err, &retryErr) {
+		t.Fatalf("EnsureLoadBalancer() error = %v, want a retry error", err)
+	}
+	skipped := false
+	for len(recorder.Events) > 0 {
+		if strings.Contains(<-recorder.Events, eventReasonIPFamilySkipped) {
+			skipped = true
+		}
+	}
+	if !skipped {
+		t.Errorf("no %s event is recorded", eventReasonIPFamilySkipped)
+	}
+
+	// the load balancer of the first family keeps its pool when the pools per family are added
+	svc.Annotations[utils.KeyIPPool] = "pool-v4,pool-v6"
+	flbs := getFamilyLoadBalancers(clusterName, svc)
+	if len(flbs) != 2 {
+		t.Fatalf("getFamilyLoadBalancers() returns %d load balancers, want 2", len(flbs))
+	}
+	lb, err := l.getLoadBalancer(flbs[0].name)
+	if err != nil || lb == nil {
+		t.Fatalf("the load balancer of the first family is not created, error: %v", err)
+	}
+	if err := l.checkAllocationRequest(svc, clusterName, flbs[0], lb); err != nil {
+		t.Errorf("checkAllocationRequest() of the existing load balancer error = %v", err)
+	}
+
+	// the pool of a single stack service still can't be changed
+	svc.Annotations[utils.KeyIPPool] = "pool-v4"
+	if err := l.checkAllocationRequest(svc, clusterName, getFamilyLoadBalancers(clusterName, svc)[0], lb); err == nil {
+		t.Errorf("checkAllocationRequest() with a changed pool succeeded")
+	}
+}
+
+func Test_dhcpRequiresLeasingAnnouncer(t *testing.T) {
+	svc := newServiceWithAnnotations(map[string]string{utils.KeyIPAM: string(lbv1.DHCP)}, nil)
+	flb := getFamilyLoadBalancers("test", svc)[0]
+
+	for announcer, wantErr := range map[string]bool{
+		utils.VIPAnnouncerKubeVip: false,
+		utils.VIPAnnouncerMetalLB: true,
+		utils.VIPAnnouncerCilium:  true,
+		utils.VIPAnnouncerNone:    true,
+	} {
+		l := newFakeLoadBalancerManager(fakeclients.NewLoadBalancerClient(), fakeclients.NewServiceClient(svc))
+		l.announcer = announcers[announcer]
+		if err := l.checkAllocationRequest(svc, "test", flb, nil); (err != nil) != wantErr {
+			t.Errorf("checkAllocationRequest() with announcer %s error = %v, wantErr %v", announcer, err, wantErr)
+		}
+	}
+}
+
+func Test_isIPPoolOfFamily(t *testing.T) {
+	newPool := func(subnets ...string) *lbv1.IPPool {
+		pool := &lbv1.IPPool{}
+		for _, subnet := range subnets {
+			pool.Spec.Ranges = append(pool.Spec.Ranges, lbv1.Range{Subnet: subnet})
+		}
+		return pool
+	}
+
+	tests := []struct {
+		name   string
+		pool   *lbv1.IPPool
+		family v1.IPFamily
+		want   bool
+	}{
+		{name: "ipv4", pool: newPool("192.168.100.0/24", "192.168.200.0/24"), family: v1.IPv4Protocol, want: true},
+		{name: "ipv6", pool: newPool("fd00::/64"), family: v1.IPv6Protocol, want: true},
+		{name: "ipv4 pool for ipv6", pool: newPool("192.168.100.0/24"), family: v1.IPv6Protocol},
+		{name: "mixed", pool: newPool("192.168.100.0/24", "fd00::/64"), family: v1.IPv4Protocol},
+		{name: "malformed", pool: newPool("192.168.100.0"), family: v1.IPv4Protocol},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isIPPoolOfFamily(tt.pool, tt.family); got != tt.want {
+				t.Errorf("isIPPoolOfFamily() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func newLoadBalancerService() *v1.Service {
+	svc := newServiceWithAnnotations(map[string]string{}, nil)
+	svc.Spec.Type = v1.ServiceTypeLoadBalancer
+	svc.Spec.Ports = []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP, NodePort: 30080}}
+	return svc
+}
+
+func newFakeLoadBalancerManager(lbClient *fakeclients.LoadBalancerClient, svcClient *fakeclients.ServiceClient) *LoadBalancerManager {
+	return &LoadBalancerManager{
+		lbClient:       lbClient,
+		localSvcClient: svcClient,
+		localSvcCache:  svcClient.Cache(),
+		configMapCache: fakeclients.NewConfigMapCache(nil, nil),
+		namespace:      "default",
+		announcer:      announcers[utils.VIPAnnouncerKubeVip],
+	}
+}
+
+func Test_allocationFlow(t *testing.T) {
+	const (
+		clusterName = "test"
+		ip          = "192.168.100.10"
+	)
+	svc := newLoadBalancerService()
+	lbClient := fakeclients.NewLoadBalancerClient()
+	svcClient := fakeclients.NewServiceClient(svc)
+	l := newFakeLoadBalancerManager(lbClient, svcClient)
+
+	// the ip is not allocated yet, the service is requeued instead of waiting
+	_, err := l.EnsureLoadBalancer(context.Background(), clusterName, svc, nil)
+	var retryErr *api.RetryError
+	if !goerrors.As(err, &retryErr) {
+		t.Fatalf("EnsureLoadBalancer() error = %v, want a retry error", err)
+	}
+	name := loadBalancerName(clusterName, svc.Namespace, svc.Name, string(svc.UID))
+	lb, err := lbClient.Get(l.namespace, name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("the pending load balancer should be kept, error: %v", err)
+	}
+	if _, exists, _ := l.GetLoadBalancer(context.Background(), clusterName, svc); !exists {
+		t.Errorf("GetLoadBalancer() reports the pending load balancer not existing")
+	}
+
+	// the handler ignores the load balancer until the ip is allocated
+	if _, err := l.OnLoadBalancerChanged("", lb); err != nil {
+		t.Fatalf("OnLoadBalancerChanged() error = %v", err)
+	}
+	if got, _ := svcClient.Cache().Get(svc.Namespace, svc.Name); got.Annotations[utils.KeyKubevipLoadBalancerIP] != "" {
+		t.Errorf("service is updated before the ip is allocated")
+	}
+
+	// the handler of a load balancer with the same service name from another guest cluster is ignored
+	other := lb.DeepCopy()
+	other.Name = loadBalancerName(clusterName, svc.Namespace, svc.Name, "another-uid")
+	other.Status.AllocatedAddress.IP = "192.168.100.11"
+	if _, err := l.OnLoadBalancerChanged("", other); err != nil {
+		t.Fatalf("OnLoadBalancerChanged() error = %v", err)
+	}
+	if got, _ := svcClient.Cache().Get(svc.Namespace, svc.Name); got.Annotations[utils.KeyKubevipLoadBalancerIP] != "" {
+		t.Errorf("service is updated by the load balancer of another service")
+	}
+
+	// Harvester allocates the ip
+	lb.Status.AllocatedAddress.IP = ip
+	lb.Status.Address = ip
+	if lb, err = lbClient.Update(lb); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.OnLoadBalancerChanged("", lb); err != nil {
+		t.Fatalf("OnLoadBalancerChanged() error = %v", err)
+	}
+	got, _ := svcClient.Cache().Get(svc.Namespace, svc.Name)
+	if got.Annotations[utils.KeyKubevipLoadBalancerIP] != ip {
+		t.Errorf("kube-vip annotation = %s, want %s", got.Annotations[utils.KeyKubevipLoadBalancerIP], ip)
+	}
+
+	// the service controller requeues the service on the annotation change
+	if _, err := l.EnsureLoadBalancer(context.Background(), clusterName, got, nil); err != nil {
+		t.Errorf("EnsureLoadBalancer() error = %v after the ip is allocated", err)
+	}
+}
+
+func Test_syncServiceConditions(t *testing.T) {
+	svc := newLoadBalancerService()
+	svcClient := fakeclients.NewServiceClient(svc)
+	l := newFakeLoadBalancerManager(fakeclients.NewLoadBalancerClient(), svcClient)
+	flbs := []familyLoadBalancer{{name: "lb"}, {name: "lb-ipv6", family: v1.IPv6Protocol, index: 1}}
+
+	lb := &lbv1.LoadBalancer{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "lb"},
+		Status: lbv1.LoadBalancerStatus{
+			Conditions: []lbv1.Condition{{
+				Type:               lbv1.LoadBalancerReady,
+				Status:             v1.ConditionFalse,
+				LastTransitionTime: "2024-01-02T03:04:05Z",
+				Message:            "no available ip in pool default",
+			}},
+		},
+	}
+	if err := l.syncServiceConditions(svc, flbs[0], lb); err != nil {
+		t.Fatalf("syncServiceConditions() error = %v", err)
+	}
+	lb.Name = "lb-ipv6"
+	lb.Status.Conditions[0].Status = v1.ConditionTrue
+	lb.Status.Conditions[0].Reason = "Allocated"
+	lb.Status.Conditions[0].Message = ""
+	if err := l.syncServiceConditions(svc, flbs[1], lb); err != nil {
+		t.Fatalf("syncServiceConditions() error = %v", err)
+	}
+
+	got, _ := svcClient.Cache().Get(svc.Namespace, svc.Name)
+	want := []metav1.Condition{
+		{
+			Type:               "HarvesterLoadBalancerReady",
+			Status:             metav1.ConditionFalse,
+			LastTransitionTime: metav1.NewTime(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)),
+			Reason:             eventReasonLoadBalancerNotReady,
+			Message:            "no available ip in pool default",
+		},
+		{
+			Type:               "HarvesterLoadBalancerIPv6Ready",
+			Status:             metav1.ConditionTrue,
+			LastTransitionTime: metav1.NewTime(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)),
+			Reason:             "Allocated",
+		},
+	}
+	if diff := cmp.Diff(want, got.Status.Conditions); diff != "" {
+		t.Errorf("unexpected service conditions (-want +got):\n%s", diff)
+	}
+}
+
+func Test_loadBalancerGC(t *testing.T) {
+	const clusterName = "test"
+	svc := newLoadBalancerService()
+	newLB := func(name, serviceName, uid string) *lbv1.LoadBalancer {
+		lb := &lbv1.LoadBalancer{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      name,
+				Labels: map[string]string{
+					utils.LBClusterNameKey:      clusterName,
+					utils.LBServiceNamespaceKey: svc.Namespace,
+					utils.LBServiceNameKey:      serviceName,
+				},
+			},
+		}
+		if uid != "" {
+			lb.Annotations = map[string]string{utils.AnnotationKeyServiceUIDOnLB: uid}
+		}
+		return lb
+	}
+	owned := newLB("owned", svc.Name, string(svc.UID))
+	// created before the uid is recorded, the owner is found by the name
+	legacy := newLB(loadBalancerName(clusterName, svc.Namespace, svc.Name, string(svc.UID)), svc.Name, "")
+	deletedService := newLB("deleted-service", "deleted", "uid-1")
+	recreatedService := newLB("recreated-service", svc.Name, "uid-2")
+	otherCluster := newLB("other-cluster", "deleted", "uid-3")
+	otherCluster.Labels[utils.LBClusterNameKey] = "other"
+
+	lbClient := fakeclients.NewLoadBalancerClient(owned, legacy, deletedService, recreatedService, otherCluster)
+	svcClient := fakeclients.NewServiceClient(svc)
+	gc := &loadBalancerGC{
+		lbClient:       lbClient,
+		localSvcClient: svcClient,
+		localSvcCache:  svcClient.Cache(),
+		namespace:      "default",
+		clusterName:    clusterName,
+		gracePeriod:    10 * time.Minute,
+		dryRun:         true,
+	}
+	remaining := func() []string {
+		list, _ := lbClient.List("default", metav1.ListOptions{})
+		names := make([]string, 0, len(list.Items))
+		for _, lb := range list.Items {
+			names = append(names, lb.Name)
+		}
+		slices.Sort(names)
+		return names
+	}
+	all := remaining()
+
+	now := time.Now()
+	for _, step := range []struct {
+		name   string
+		now    time.Time
+		dryRun bool
+		want   []string
+	}{
+		{name: "orphans are found", now: now, want: all},
+		{name: "within the grace period", now: now.Add(5 * time.Minute), want: all},
+		{name: "dry run", now: now.Add(10 * time.Minute), dryRun: true, want: all},
+		{name: "orphans are deleted", now: now.Add(11 * time.Minute), want: []string{legacy.Name, "other-cluster", "owned"}},
+	} {
+		gc.dryRun = step.dryRun
+		if err := gc.collect(step.now); err != nil {
+			t.Fatalf("%s: collect() error = %v", step.name, err)
+		}
+		slices.Sort(step.want)
+		if diff := cmp.Diff(step.want, remaining()); diff != "" {
+			t.Errorf("%s: unexpected load balancers (-want +got):\n%s", step.name, diff)
+		}
+	}
+}
+
+func Test_secondaryServicesFinalizer(t *testing.T) {
+	const clusterName = "test"
+	primary := newLoadBalancerService()
+	primary.Labels = map[string]string{utils.KeyPrimaryService: ""}
+	primary.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "192.168.100.10"}}
+	secondary := newLoadBalancerService()
+	secondary.Name = "secondary"
+	secondary.UID = "secondary-uid"
+	secondary.Annotations[utils.KeyPrimaryService] = primary.Namespace + "/" + primary.Name
+	secondary.Spec.Ports[0].Port = 8080
+
+	svcClient := fakeclients.NewServiceClient(primary, secondary)
+	l := newFakeLoadBalancerManager(fakeclients.NewLoadBalancerClient(), svcClient)
+	hasFinalizer := func() bool {
+		svc, _ := svcClient.Cache().Get(primary.Namespace, primary.Name)
+		return slices.Contains(svc.Finalizers, utils.FinalizerSecondaryServices)
+	}
+
+	if _, err := l.EnsureLoadBalancer(context.Background(), clusterName, secondary, nil); err != nil {
+		t.Fatalf("EnsureLoadBalancer() error = %v", err)
+	}
+	if !hasFinalizer() {
+		t.Fatalf("primary service has no finalizer while a secondary service is attached")
+	}
+
+	// the primary service is being deleted
+	deleting, _ := svcClient.Cache().Get(primary.Namespace, primary.Name)
+	deleting.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+	if _, err := svcClient.Update(deleting); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.EnsureLoadBalancerDeleted(context.Background(), clusterName, deleting); err == nil {
+		t.Errorf("EnsureLoadBalancerDeleted() of the primary service should fail while a secondary service is attached")
+	}
+	if !hasFinalizer() {
+		t.Fatalf("finalizer is removed while a secondary service is attached")
+	}
+
+	// the secondary service is deleted
+	attached, _ := svcClient.Cache().Get(secondary.Namespace, secondary.Name)
+	if err := l.EnsureLoadBalancerDeleted(context.Background(), clusterName, attached); err != nil {
+		t.Fatalf("EnsureLoadBalancerDeleted() of the secondary service error = %v", err)
+	}
+	if hasFinalizer() {
+		t.Errorf("finalizer is not removed after the last secondary service is deleted")
+	}
+	if err := svcClient.Delete(secondary.Namespace, secondary.Name, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.EnsureLoadBalancerDeleted(context.Background(), clusterName, deleting); err != nil {
+		t.Errorf("EnsureLoadBalancerDeleted() of the primary service error = %v", err)
+	}
+}
+
+func Test_pickServiceToPromote(t *testing.T) {
+	const clusterName = "test"
+	requireDualStack := v1.IPFamilyPolicyRequireDualStack
+	singleStack := v1.IPFamilyPolicySingleStack
+	newService := func(name string, policy *v1.IPFamilyPolicy, families ...v1.IPFamily) *v1.Service {
+		svc := newLoadBalancerService()
+		svc.Name = name
+		svc.Spec.IPFamilyPolicy = policy
+		svc.Spec.IPFamilies = families
+		return svc
+	}
+	primary := newService("primary", &requireDualStack, v1.IPv4Protocol, v1.IPv6Protocol)
+	primary.Annotations[utils.KeyIPPool] = "pool-v4,pool-v6"
+	singleStackPreferred := newService("single-stack", &singleStack, v1.IPv4Protocol)
+	singleStackPreferred.Annotations[utils.KeyPromoteOnPrimaryDelete] = "true"
+	dualStack := newService("dual-stack", &requireDualStack, v1.IPv4Protocol, v1.IPv6Protocol)
+
+	if got := pickServiceToPromote(clusterName, primary, []*v1.Service{singleStackPreferred, dualStack}); got == nil || got.Name != dualStack.Name {
+		t.Errorf("pickServiceToPromote() = %v, want %s", got, dualStack.Name)
+	}
+	if got := pickServiceToPromote(clusterName, primary, []*v1.Service{singleStackPreferred}); got != nil {
+		t.Errorf("pickServiceToPromote() = %s, want none as the ip families differ", got.Name)
+	}
+}
+
+func Test_promoteSecondaryService(t *testing.T) {
+	const clusterName = "test"
+	primary := newLoadBalancerService()
+	primary.Annotations[utils.KeyPromoteOnPrimaryDelete] = "true"
+	primary.Annotations[utils.KeyIPPool] = "pool1"
+	primary.Labels = map[string]string{utils.KeyPrimaryService: ""}
+	primary.Finalizers = []string{utils.FinalizerSecondaryServices}
+	primary.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+	primary.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "192.168.100.10"}}
+	lbName := loadBalancerName(clusterName, primary.Namespace, primary.Name, string(primary.UID))
+
+	newSecondary := func(name string, created time.Time) *v1.Service {
+		svc := newLoadBalancerService()
+		svc.Name = name
+		svc.UID = types.UID(name + "-uid")
+		svc.CreationTimestamp = metav1.Time{Time: created}
+		svc.Annotations[utils.KeyPrimaryService] = primary.Namespace + "/" + primary.Name
+		svc.Labels = map[string]string{utils.KeyPrimaryService: primaryServiceLabelValue(primary)}
+		return svc
+	}
+	now := time.Now()
+	oldest := newSecondary("oldest", now.Add(-2*time.Hour))
+	preferred := newSecondary("preferred", now.Add(-time.Hour))
+	preferred.Annotations[utils.KeyPromoteOnPrimaryDelete] = "true"
+
+	lbClient := fakeclients.NewLoadBalancerClient(&lbv1.LoadBalancer{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      lbName,
+			Labels: map[string]string{
+				utils.LBServiceNamespaceKey: primary.Namespace,
+				utils.LBServiceNameKey:      primary.Name,
+			},
+			Annotations: map[string]string{utils.AnnotationKeyServiceUIDOnLB: string(primary.UID)},
+		},
+	})
+	svcClient := fakeclients.NewServiceClient(primary, oldest, preferred)
+	l := newFakeLoadBalancerManager(lbClient, svcClient)
+
+	if err := l.EnsureLoadBalancerDeleted(context.Background(), clusterName, primary); err != nil {
+		t.Fatalf("EnsureLoadBalancerDeleted() error = %v", err)
+	}
+	// promoting again after the primary service is released changes nothing
+	if err := l.EnsureLoadBalancerDeleted(context.Background(), clusterName, primary); err != nil {
+		t.Fatalf("EnsureLoadBalancerDeleted() retry error = %v", err)
+	}
+
+	lb, err := lbClient.Get("default", lbName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("load balancer is deleted: %v", err)
+	}
+	if owner := lb.Labels[utils.LBServiceNameKey]; owner != preferred.Name {
+		t.Errorf("load balancer is handed over to %s, want %s", owner, preferred.Name)
+	}
+	if uid := lb.Annotations[utils.AnnotationKeyServiceUIDOnLB]; uid != string(preferred.UID) {
+		t.Errorf("load balancer owner uid = %s, want %s", uid, preferred.UID)
+	}
+
+	promoted, _ := svcClient.Cache().Get(preferred.Namespace, preferred.Name)
+	if _, ok := promoted.Annotations[utils.KeyPrimaryService]; ok {
+		t.Errorf("promoted service still has annotation %s", utils.KeyPrimaryService)
+	}
+	if diff := cmp.Diff(lbName, getFamilyLoadBalancers(clusterName, promoted)[0].name); diff != "" {
+		t.Errorf("load balancer name of the promoted service (-want +got):\n%s", diff)
+	}
+	if pool := promoted.Annotations[utils.KeyIPPool]; pool != "pool1" {
+		t.Errorf("ip pool of the promoted service = %s, want pool1", pool)
+	}
+
+	moved, _ := svcClient.Cache().Get(oldest.Namespace, oldest.Name)
+	if diff := cmp.Diff(promoted.Namespace+"/"+promoted.Name, moved.Annotations[utils.KeyPrimaryService]); diff != "" {
+		t.Errorf("primary service of the other secondary service (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(primaryServiceLabelValue(promoted), moved.Labels[utils.KeyPrimaryService]); diff != "" {
+		t.Errorf("primary service label of the other secondary service (-want +got):\n%s", diff)
+	}
+
+	released, _ := svcClient.Cache().Get(primary.Namespace, primary.Name)
+	if slices.Contains(released.Finalizers, utils.FinalizerSecondaryServices) {
+		t.Errorf("finalizer of the deleted primary service is not removed")
+	}
+}
+
+func Test_reservePorts(t *testing.T) {
+	primary := newLoadBalancerService()
+	newSecondary := func(name string, protocol v1.Protocol, port int32) *v1.Service {
+		svc := newLoadBalancerService()
+		svc.Name = name
+		svc.UID = types.UID(name + "-uid")
+		svc.Annotations[utils.KeyPrimaryService] = primary.Namespace + "/" + primary.Name
+		svc.Spec.Ports = []v1.ServicePort{{Name: "dns", Port: port, Protocol: protocol}}
+		return svc
+	}
+	// the secondary services are not labeled yet, they can't see each other by listing
+	dnsTCP := newSecondary("dns-tcp", v1.ProtocolTCP, 53)
+	dnsUDP := newSecondary("dns-udp", v1.ProtocolUDP, 53)
+	racer := newSecondary("racer", "", 53)
+	http := newSecondary("http", v1.ProtocolTCP, 80)
+
+	svcClient := fakeclients.NewServiceClient(primary, dnsTCP, dnsUDP, racer, http)
+	l := newFakeLoadBalancerManager(fakeclients.NewLoadBalancerClient(), svcClient)
+
+	steps := []struct {
+		name      string
+		secondary *v1.Service
+		release   bool
+		wantErr   bool
+	}{
+		{name: "TCP/53 is reserved", secondary: dnsTCP},
+		{name: "UDP/53 coexists with TCP/53", secondary: dnsUDP},
+		{name: "reserving again is a no-op", secondary: dnsTCP},
+		{name: "TCP/53 is reserved by another service", secondary: racer, wantErr: true},
+		{name: "TCP/80 is used by the primary service", secondary: http, wantErr: true},
+		{name: "TCP/53 is released", secondary: dnsTCP, release: true},
+		{name: "the released port can be reserved", secondary: racer},
+	}
+	for _, step := range steps {
+		var err error
+		if step.release {
+			err = l.releasePorts(primary, step.secondary)
+		} else {
+			err = l.reservePorts(primary, step.secondary)
+		}
+		if (err != nil) != step.wantErr {
+			t.Fatalf("%s: error = %v, wantErr %v", step.name, err, step.wantErr)
+		}
+	}
+
+	latest, _ := svcClient.Get(primary.Namespace, primary.Name, metav1.GetOptions{})
+	want := `{"TCP/53":"default/racer","UDP/53":"default/dns-udp"}`
+	if diff := cmp.Diff(want, latest.Annotations[utils.KeyPortReservations]); diff != "" {
+		t.Errorf("port reservations (-want +got):\n%s", diff)
+	}
+
+	// the reservation of a service which is deleted without releasing it is stale
+	if err := svcClient.Delete(racer.Namespace, racer.Name, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.reservePorts(primary, dnsTCP); err != nil {
+		t.Errorf("reserving the port of a deleted service error = %v", err)
+	}
+}
+
+func Test_portConflicts(t *testing.T) {
+	primary := newLoadBalancerService()
+	dns := newLoadBalancerService()
+	dns.Name, dns.UID = "dns", "dns-uid"
+	dns.Annotations[utils.KeyPrimaryService] = primary.Namespace + "/" + primary.Name
+	dns.Spec.Ports = []v1.ServicePort{{Name: "dns", Port: 53, Protocol: v1.ProtocolTCP}}
+	mixed := newLoadBalancerService()
+	mixed.Name, mixed.UID = "mixed", "mixed-uid"
+	mixed.Annotations[utils.KeyPrimaryService] = primary.Namespace + "/" + primary.Name
+	mixed.Spec.Ports = []v1.ServicePort{
+		{Name: "http", Port: 80, Protocol: v1.ProtocolTCP},
+		{Name: "dns-tcp", Port: 53, Protocol: v1.ProtocolTCP},
+		{Name: "dns-udp", Port: 53, Protocol: v1.ProtocolUDP},
+	}
+
+	svcClient := fakeclients.NewServiceClient(primary, dns, mixed)
+	l := newFakeLoadBalancerManager(fakeclients.NewLoadBalancerClient(), svcClient)
+	if err := l.reservePorts(primary, dns); err != nil {
+		t.Fatalf("reservePorts() error = %v", err)
+	}
+
+	// every conflicting port of the secondary service is listed
+	var conflictErr *portConflictError
+	if err := l.reservePorts(primary, mixed); !goerrors.As(err, &conflictErr) {
+		t.Fatalf("reservePorts() error = %v, want a port conflict error", err)
+	}
+	want := []portConflict{
+		{port: "TCP/80", owner: "default/test-svc"},
+		{port: "TCP/53", owner: "default/dns"},
+	}
+	if diff := cmp.Diff(want, conflictErr.conflicts, cmp.AllowUnexported(portConflict{})); diff != "" {
+		t.Errorf("conflicts (-want +got):\n%s", diff)
+	}
+
+	// the primary service can't take the port reserved by the secondary service
+	latest, _ := svcClient.Get(primary.Namespace, primary.Name, metav1.GetOptions{})
+	latest.Spec.Ports = append(latest.Spec.Ports, v1.ServicePort{Name: "dns", Port: 53})
+	if err := l.checkPrimaryPorts(latest); !goerrors.As(err, &conflictErr) {
+		t.Fatalf("checkPrimaryPorts() error = %v, want a port conflict error", err)
+	}
+	want = []portConflict{{port: "TCP/53", owner: "default/dns"}}
+	if diff := cmp.Diff(want, conflictErr.conflicts, cmp.AllowUnexported(portConflict{})); diff != "" {
+		t.Errorf("conflicts of the primary service (-want +got):\n%s", diff)
+	}
+	latest.Spec.Ports[1].Protocol = v1.ProtocolUDP
+	if err := l.checkPrimaryPorts(latest); err != nil {
+		t.Errorf("checkPrimaryPorts() error = %v, UDP/53 is not reserved", err)
+	}
+
+	// without the reservations, the ports of the current secondary services are checked
+	dns.Labels = map[string]string{utils.KeyPrimaryService: primaryServiceLabelValue(primary)}
+	l = newFakeLoadBalancerManager(fakeclients.NewLoadBalancerClient(), fakeclients.NewServiceClient(primary, dns))
+	unreserved := primary.DeepCopy()
+	unreserved.Spec.Ports = append(unreserved.Spec.Ports, v1.ServicePort{Name: "dns", Port: 53})
+	if err := l.checkPrimaryPorts(unreserved); !goerrors.As(err, &conflictErr) {
+		t.Fatalf("checkPrimaryPorts() without reservations error = %v, want a port conflict error", err)
+	}
+	if diff := cmp.Diff(want, conflictErr.conflicts, cmp.AllowUnexported(portConflict{})); diff != "" {
+		t.Errorf("conflicts without reservations (-want +got):\n%s", diff)
+	}
+}
+
+func Test_networkMigration(t *testing.T) {
+	const (
+		clusterName = "test"
+		oldIP       = "192.168.100.10"
+		newIP       = "10.0.0.10"
+	)
+	svc := newLoadBalancerService()
+	svc.Annotations[utils.KeyNetwork] = "default/net1"
+	secondary := newLoadBalancerService()
+	secondary.Name, secondary.UID = "secondary", "secondary-uid"
+	secondary.Annotations[utils.KeyPrimaryService] = svc.Namespace + "/" + svc.Name
+	secondary.Spec.Ports[0].Port = 8080
+	lbClient := fakeclients.NewLoadBalancerClient()
+	svcClient := fakeclients.NewServiceClient(svc, secondary)
+	l := newFakeLoadBalancerManager(lbClient, svcClient)
+	allocate := func(name, ip string) {
+		lb, err := lbClient.Get(l.namespace, name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("load balancer %s is not created: %v", name, err)
+		}
+		lb.Status.AllocatedAddress.IP = ip
+		lb.Status.Address = ip
+		if _, err := lbClient.Update(lb); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ensure := func(svc *v1.Service) error {
+		latest, _ := svcClient.Get(svc.Namespace, svc.Name, metav1.GetOptions{})
+		_, err := l.EnsureLoadBalancer(context.Background(), clusterName, latest, nil)
+		return err
+	}
+
+	// the service gets its address on net1 and shares it with the secondary service
+	oldName := loadBalancerName(clusterName, svc.Namespace, svc.Name, string(svc.UID))
+	_ = ensure(svc)
+	allocate(oldName, oldIP)
+	if err := ensure(svc); err != nil {
+		t.Fatalf("EnsureLoadBalancer() error = %v", err)
+	}
+	// kube-vip updates the status
+	latest, _ := svcClient.Get(svc.Namespace, svc.Name, metav1.GetOptions{})
+	latest.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: oldIP}}
+	if _, err := svcClient.UpdateStatus(latest); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensure(secondary); err != nil {
+		t.Fatalf("EnsureLoadBalancer() of the secondary service error = %v", err)
+	}
+
+	// the network can't be changed without the migration annotation
+	latest, _ = svcClient.Get(svc.Namespace, svc.Name, metav1.GetOptions{})
+	latest.Annotations[utils.KeyNetwork] = "default/net2"
+	if _, err := svcClient.Update(latest); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensure(svc); err == nil {
+		t.Fatalf("EnsureLoadBalancer() should fail as the network is changed")
+	}
+
+	// the old address is kept until the address on net2 is allocated
+	latest, _ = svcClient.Get(svc.Namespace, svc.Name, metav1.GetOptions{})
+	latest.Annotations[utils.KeyAllowNetworkMigration] = "true"
+	if _, err := svcClient.Update(latest); err != nil {
+		t.Fatal(err)
+	}
+	recorder := record.NewFakeRecorder(100)
+	l.recorder = recorder
+	var retryErr *api.RetryError
+	for range 2 {
+		if err := ensure(svc); !goerrors.As(err, &retryErr) {
+			t.Fatalf("EnsureLoadBalancer() error = %v, want a retry error", err)
+		}
+	}
+	latest, _ = svcClient.Get(svc.Namespace, svc.Name, metav1.GetOptions{})
+	if got := latest.Annotations[utils.KeyKubevipLoadBalancerIP]; got != oldIP {
+		t.Errorf("kube-vip annotation = %s during the migration, want %s", got, oldIP)
+	}
+	// the event is recorded once when the migration starts, not on every retry
+	migrating := 0
+	for len(recorder.Events) > 0 {
+		if strings.Contains(<-recorder.Events, eventReasonNetworkMigrating) {
+			migrating++
+		}
+	}
+	if migrating != 1 {
+		t.Errorf("%s events = %d, want 1", eventReasonNetworkMigrating, migrating)
+	}
+
+	newName := migrationLoadBalancerName(clusterName, svc, "", "default/net2")
+	allocate(newName, newIP)
+	// the handler switches the service to the new address as soon as it's allocated
+	newLB, _ := lbClient.Get(l.namespace, newName, metav1.GetOptions{})
+	if _, err := l.OnLoadBalancerChanged("", newLB); err != nil {
+		t.Fatalf("OnLoadBalancerChanged() error = %v", err)
+	}
+	latest, _ = svcClient.Get(svc.Namespace, svc.Name, metav1.GetOptions{})
+	if got := latest.Annotations[utils.KeyKubevipLoadBalancerIP]; got != newIP {
+		t.Errorf("kube-vip annotation = %s, want %s", got, newIP)
+	}
+
+	if err := ensure(svc); err != nil {
+		t.Fatalf("EnsureLoadBalancer() error = %v after the new address is allocated", err)
+	}
+
+	latest, _ = svcClient.Get(svc.Namespace, svc.Name, metav1.GetOptions{})
+	if diff := cmp.Diff(newName, getFamilyLoadBalancers(clusterName, latest)[0].name); diff != "" {
+		t.Errorf("load balancer name (-want +got):\n%s", diff)
+	}
+	if _, err := lbClient.Get(l.namespace, oldName, metav1.GetOptions{}); !errors.IsNotFound(err) {
+		t.Errorf("load balancer on the former network is not deleted, error: %v", err)
+	}
+	moved, _ := svcClient.Get(secondary.Namespace, secondary.Name, metav1.GetOptions{})
+	if got := moved.Annotations[utils.KeyKubevipLoadBalancerIP]; got != newIP {
+		t.Errorf("kube-vip annotation of the secondary service = %s, want %s", got, newIP)
+	}
+	if got := moved.Annotations[utils.KeyNetwork]; got != "default/net2" {
+		t.Errorf("network of the secondary service = %s, want default/net2", got)
+	}
+
+	// the migrated service is ensured as usual
+	if err := ensure(svc); err != nil {
+		t.Errorf("EnsureLoadBalancer() error = %v after the migration", err)
+	}
+}
+
+func Test_networkMigrationChecks(t *testing.T) {
+	const clusterName = "test"
+	svc := newLoadBalancerService()
+	svc.Annotations[utils.KeyNetwork] = "default/net2"
+	svc.Annotations[utils.KeyAllowNetworkMigration] = "true"
+	oldName := loadBalancerName(clusterName, svc.Namespace, svc.Name, string(svc.UID))
+	targetName := migrationLoadBalancerName(clusterName, svc, "", "default/net2")
+	newLB := func(name, cluster string) *lbv1.LoadBalancer {
+		return &lbv1.LoadBalancer{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "default",
+				Name:        name,
+				Labels:      map[string]string{utils.LBClusterNameKey: cluster},
+				Annotations: map[string]string{utils.AnnotationKeyNetworkOnLB: "default/net1"},
+			},
+		}
+	}
+
+	// the load balancer on the new network of another cluster isn't taken over
+	lbClient := fakeclients.NewLoadBalancerClient(newLB(oldName, clusterName), newLB(targetName, "other"))
+	l := newFakeLoadBalancerManager(lbClient, fakeclients.NewServiceClient(svc))
+	var retryErr *api.RetryError
+	if _, err := l.EnsureLoadBalancer(context.Background(), clusterName, svc, nil); err == nil || goerrors.As(err, &retryErr) {
+		t.Errorf("EnsureLoadBalancer() error = %v, want a conflict as the load balancer on the new network belongs to another cluster", err)
+	}
+
+	// the ports conflicting with a secondary service fail the migration before the load balancers are created
+	secondary := newLoadBalancerService()
+	secondary.Name, secondary.UID = "secondary", "secondary-uid"
+	secondary.Annotations[utils.KeyPrimaryService] = svc.Namespace + "/" + svc.Name
+	secondary.Labels = map[string]string{utils.KeyPrimaryService: primaryServiceLabelValue(svc)}
+	lbClient = fakeclients.NewLoadBalancerClient(newLB(oldName, clusterName))
+	l = newFakeLoadBalancerManager(lbClient, fakeclients.NewServiceClient(svc, secondary))
+	var conflictErr *portConflictError
+	if _, err := l.EnsureLoadBalancer(context.Background(), clusterName, svc, nil); !goerrors.As(err, &conflictErr) {
+		t.Errorf("EnsureLoadBalancer() error = %v, want a port conflict error", err)
+	}
+	if _, err := lbClient.Get("default", targetName, metav1.GetOptions{}); !errors.IsNotFound(err) {
+		t.Errorf("the load balancer on the new network is created despite the port conflict, error: %v", err)
+	}
+}
+
+func Test_setBackendServers(t *testing.T) {
+	newNode := func(name string, nodeLabels map[string]string) *v1.Node {
+		return &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: nodeLabels}}
+	}
+	nodes := []*v1.Node{
+		newNode("worker-2", nil),
+		newNode("ingress-1", map[string]string{"node-role.kubernetes.io/ingress": "true"}),
+		newNode("worker-1", nil),
+		newNode("host-ingress-2", map[string]string{"node-role.kubernetes.io/ingress": "true"}),
+		newNode("excluded", map[string]string{v1.LabelNodeExcludeBalancers: ""}),
+		{ObjectMeta: metav1.ObjectMeta{Name: "cordoned"}, Spec: v1.NodeSpec{Unschedulable: true}},
+	}
+	nodeToVMName := &sync.Map{}
+	nodeToVMName.Store("host-ingress-2", "ingress-2")
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		// the external traffic policy Local
+		local            bool
+		wantWorkloadType lbv1.WorkloadType
+		wantSelector     map[string][]string
+		wantBackendVMs   string
+		wantErr          bool
+	}{
+		{
+			name:             "cluster by default",
+			annotations:      map[string]string{},
+			wantWorkloadType: lbv1.Cluster,
+			wantBackendVMs:   "ingress-1,ingress-2,worker-1,worker-2",
+		},
+		{
+			name:             "vm with all nodes",
+			annotations:      map[string]string{utils.KeyWorkloadType: string(lbv1.VM)},
+			wantWorkloadType: lbv1.VM,
+			wantSelector:     map[string][]string{"harvesterhci.io/vmName": {"ingress-1", "ingress-2", "worker-1", "worker-2"}},
+			wantBackendVMs:   "ingress-1,ingress-2,worker-1,worker-2",
+		},
+		{
+			name: "vm with the selected nodes mapped to vm names",
+			annotations: map[string]string{
+				utils.KeyWorkloadType:        string(lbv1.VM),
+				utils.KeyBackendNodeSelector: "node-role.kubernetes.io/ingress=true",
+			},
+			wantWorkloadType: lbv1.VM,
+			wantSelector:     map[string][]string{"harvesterhci.io/vmName": {"ingress-1", "ingress-2"}},
+			wantBackendVMs:   "ingress-1,ingress-2",
+		},
+		{
+			name: "vm without any matched node",
+			annotations: map[string]string{
+				utils.KeyWorkloadType:        string(lbv1.VM),
+				utils.KeyBackendNodeSelector: "node-role.kubernetes.io/storage=true",
+			},
+			wantWorkloadType: lbv1.VM,
+		},
+		{
+			name:             "vm with the nodes of the local endpoints",
+			annotations:      map[string]string{utils.KeyWorkloadType: string(lbv1.VM)},
+			local:            true,
+			wantWorkloadType: lbv1.VM,
+			wantSelector:     map[string][]string{"harvesterhci.io/vmName": {"ingress-2", "worker-1"}},
+			wantBackendVMs:   "ingress-2,worker-1",
+		},
+		{
+			name:             "cluster isn't restricted to the nodes of the local endpoints",
+			annotations:      map[string]string{},
+			local:            true,
+			wantWorkloadType: lbv1.Cluster,
+			wantBackendVMs:   "ingress-1,ingress-2,worker-1,worker-2",
+		},
+		{
+			name:        "invalid workload type",
+			annotations: map[string]string{utils.KeyWorkloadType: "pod"},
+			wantErr:     true,
+		},
+		{
+			name: "invalid node selector",
+			annotations: map[string]string{
+				utils.KeyWorkloadType:        string(lbv1.VM),
+				utils.KeyBackendNodeSelector: "a in (b",
+			},
+			wantErr: true,
+		},
+	}
+
+	l := &LoadBalancerManager{vmNames: &instanceManager{nodeToVMName: nodeToVMName}, localEndpointSliceCache: fakeclients.NewEndpointSliceCache(newLocalEndpointSlice())}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := &lbv1.LoadBalancer{}
+			svc := newServiceWithAnnotations(tt.annotations, nil)
+			if tt.local {
+				svc.Spec.ExternalTrafficPolicy = v1.ServiceExternalTrafficPolicyLocal
+			}
+			err := l.setBackendServers(lb, svc, nodes)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("setBackendServers() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if lb.Spec.WorkloadType != tt.wantWorkloadType {
+				t.Errorf("workload type = %s, want %s", lb.Spec.WorkloadType, tt.wantWorkloadType)
+			}
+			if diff := cmp.Diff(tt.wantSelector, lb.Spec.BackendServerSelector); diff != "" {
+				t.Errorf("backend server selector (-want +got):\n%s", diff)
+			}
+			if got := lb.Annotations[utils.AnnotationKeyBackendVMsOnLB]; got != tt.wantBackendVMs {
+				t.Errorf("backend vms = %s, want %s", got, tt.wantBackendVMs)
+			}
+		})
+	}
+}
+
+// newLocalEndpointSlice returns the endpoint slice of default/test-svc ready on worker-1 and host-ingress-2, and not
+// ready on worker-2.
+func newLocalEndpointSlice() *discoveryv1.EndpointSlice {
+	nodeName := func(name string) *string { return &name }
+	notReady := false
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "test-svc-abcde",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: "test-svc"},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Endpoints: []discoveryv1.Endpoint{
+			{Addresses: []string{"10.42.0.10"}, NodeName: nodeName("worker-1")},
+			{Addresses: []string{"10.42.1.10"}, NodeName: nodeName("host-ingress-2")},
+			{Addresses: []string{"10.42.2.10"}, NodeName: nodeName("worker-2"), Conditions: discoveryv1.EndpointConditions{Ready: &notReady}},
+		},
+	}
+}
+
+func Test_OnEndpointSliceChanged(t *testing.T) {
+	svc := newServiceWithAnnotations(map[string]string{utils.KeyWorkloadType: string(lbv1.VM)}, nil)
+	svc.Spec.Type = v1.ServiceTypeLoadBalancer
+	svc.Spec.ExternalTrafficPolicy = v1.ServiceExternalTrafficPolicyLocal
+	lbName := getFamilyLoadBalancers(cfg.GetConfig().ClusterName, svc)[0].name
+	lbClient := fakeclients.NewLoadBalancerClient(&lbv1.LoadBalancer{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: lbName},
+		Spec: lbv1.LoadBalancerSpec{
+			WorkloadType:          lbv1.VM,
+			BackendServerSelector: map[string][]string{"harvesterhci.io/vmName": {"worker-1", "worker-2"}},
+		},
+	})
+	l := newFakeLoadBalancerManager(lbClient, fakeclients.NewServiceClient(svc))
+	l.localNodeCache = fakeclients.NewNodeClient(
+		&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "worker-1"}},
+		&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "worker-2"}},
+		&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "host-ingress-2"}},
+	).Cache()
+
+	slice := newLocalEndpointSlice()
+	for _, step := range []struct {
+		name string
+		// the nodes of the ready endpoints
+		nodes []string
+		want  map[string][]string
+	}{
+		{name: "the endpoints are ready on worker-1 and host-ingress-2", nodes: []string{"worker-1", "host-ingress-2"},
+			want: map[string][]string{"harvesterhci.io/vmName": {"host-ingress-2", "worker-1"}}},
+		{name: "the endpoints are moved to worker-2", nodes: []string{"worker-2"},
+			want: map[string][]string{"harvesterhci.io/vmName": {"worker-2"}}},
+		{name: "no ready endpoint"},
+	} {
+		slice.Endpoints = nil
+		for _, node := range step.nodes {
+			slice.Endpoints = append(slice.Endpoints, discoveryv1.Endpoint{Addresses: []string{"10.42.0.10"}, NodeName: &node})
+		}
+		l.localEndpointSliceCache = fakeclients.NewEndpointSliceCache(slice)
+		if _, err := l.OnEndpointSliceChanged("", slice); err != nil {
+			t.Fatalf("%s: OnEndpointSliceChanged() error = %v", step.name, err)
+		}
+		lb, err := lbClient.Get("default", lbName, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(step.want, lb.Spec.BackendServerSelector); diff != "" {
+			t.Errorf("%s: backend server selector (-want +got):\n%s", step.name, diff)
+		}
+	}
+
+	// the backend servers of the services with the external traffic policy Cluster are not touched
+	lb, _ := lbClient.Get("default", lbName, metav1.GetOptions{})
+	want := map[string][]string{"harvesterhci.io/vmName": {"worker-1", "worker-2"}}
+	lb.Spec.BackendServerSelector = want
+	if _, err := lbClient.Update(lb); err != nil {
+		t.Fatal(err)
+	}
+	svc.Spec.ExternalTrafficPolicy = v1.ServiceExternalTrafficPolicyCluster
+	l.localSvcCache = fakeclients.NewServiceClient(svc).Cache()
+	if _, err := l.OnEndpointSliceChanged("", newLocalEndpointSlice()); err != nil {
+		t.Fatalf("OnEndpointSliceChanged() error = %v", err)
+	}
+	lb, _ = lbClient.Get("default", lbName, metav1.GetOptions{})
+	if diff := cmp.Diff(want, lb.Spec.BackendServerSelector); diff != "" {
+		t.Errorf("backend server selector of policy Cluster (-want +got):\n%s", diff)
+	}
+}
+
+func Test_checkWorkloadTypeChanged(t *testing.T) {
+	tests := []struct {
+		name         string
+		annotations  map[string]string
+		workloadType lbv1.WorkloadType
+		wantErr      bool
+	}{
+		{
+			name:         "unchanged",
+			annotations:  map[string]string{utils.KeyWorkloadType: string(lbv1.VM)},
+			workloadType: lbv1.VM,
+		},
+		{
+			name:        "load balancer created without workload type",
+			annotations: map[string]string{},
+		},
+		{
+			name:         "changed from cluster to vm",
+			annotations:  map[string]string{utils.KeyWorkloadType: string(lbv1.VM)},
+			workloadType: lbv1.Cluster,
+			wantErr:      true,
+		},
+		{
+			name:         "changed from vm to cluster",
+			annotations:  map[string]string{},
+			workloadType: lbv1.VM,
+			wantErr:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := &lbv1.LoadBalancer{Spec: lbv1.LoadBalancerSpec{WorkloadType: tt.workloadType}}
+			err := checkWorkloadTypeChanged(newServiceWithAnnotations(tt.annotations, nil), lb)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkWorkloadTypeChanged() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_syncBackendServers(t *testing.T) {
+	svc := newLoadBalancerService()
+	svcClient := fakeclients.NewServiceClient(svc)
+	l := newFakeLoadBalancerManager(fakeclients.NewLoadBalancerClient(), svcClient)
+
+	steps := []struct {
+		servers []string
+		want    string
+	}{
+		{servers: []string{"10.0.0.2", "10.0.0.1"}, want: "10.0.0.1,10.0.0.2"},
+		{servers: []string{"10.0.0.1"}, want: "10.0.0.1"},
+		{servers: nil, want: ""},
+	}
+	for _, step := range steps {
+		latest, _ := svcClient.Get(svc.Namespace, svc.Name, metav1.GetOptions{})
+		lb := &lbv1.LoadBalancer{Status: lbv1.LoadBalancerStatus{BackendServers: step.servers}}
+		if err := l.syncBackendServers(latest, lb); err != nil {
+			t.Fatalf("syncBackendServers() error = %v", err)
+		}
+		latest, _ = svcClient.Get(svc.Namespace, svc.Name, metav1.GetOptions{})
+		if got := latest.Annotations[utils.KeyBackendServers]; got != step.want {
+			t.Errorf("backend servers = %q, want %q", got, step.want)
+		}
+	}
+}
+
+func Test_loadBalancerStatus(t *testing.T) {
+	const clusterName = "test"
+	proxy := v1.LoadBalancerIPModeProxy
+
+	tests := []struct {
+		name         string
+		directStatus bool
+		ipMode       v1.LoadBalancerIPMode
+		hostname     string
+		ips          []string
+		want         *v1.LoadBalancerStatus
+	}{
+		{
+			name: "left to kube-vip",
+			ips:  []string{"192.168.100.10"},
+			want: &v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{IP: "192.168.100.1"}}},
+		},
+		{
+			name:         "direct status",
+			directStatus: true,
+			ips:          []string{"192.168.100.10", "fd00::10"},
+			want:         &v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{IP: "192.168.100.10"}, {IP: "fd00::10"}}},
+		},
+		{
+			name:         "direct status with ipMode and hostname",
+			directStatus: true,
+			ipMode:       v1.LoadBalancerIPModeProxy,
+			hostname:     "{{.Name}}.{{.Namespace}}.{{.ClusterName}}.example.com",
+			ips:          []string{"192.168.100.10", "fd00::10"},
+			want: &v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{
+				{IP: "192.168.100.10", IPMode: &proxy},
+				{IP: "fd00::10", IPMode: &proxy},
+				{Hostname: "test-svc.default.test.example.com"},
+			}},
+		},
+		{
+			name:         "direct status of dhcp left to kube-vip",
+			directStatus: true,
+			ips:          []string{"0.0.0.0"},
+			want:         &v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{IP: "192.168.100.1"}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newServiceWithAnnotations(nil, nil)
+			svc.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "192.168.100.1"}}
+			l := newFakeLoadBalancerManager(fakeclients.NewLoadBalancerClient(), fakeclients.NewServiceClient(svc))
+			l.directStatus, l.ipMode = tt.directStatus, tt.ipMode
+			tmpl, err := utils.ParseLoadBalancerHostnameTemplate(tt.hostname)
+			if err != nil {
+				t.Fatalf("ParseLoadBalancerHostnameTemplate() error = %v", err)
+			}
+			l.hostnameTemplate = tmpl
+
+			got, err := l.loadBalancerStatus(clusterName, svc, tt.ips)
+			if err != nil {
+				t.Fatalf("loadBalancerStatus() error = %v", err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("loadBalancerStatus() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_announcer(t *testing.T) {
+	const (
+		ip         = "192.168.100.10,fd00::10"
+		iface      = "eth1"
+		sharingKey = "default.primary"
+	)
+
+	tests := []struct {
+		name            string
+		announcer       string
+		wantAnnotations map[string]string
+		wantLabels      map[string]string
+	}{
+		{
+			name:            "kube-vip",
+			announcer:       utils.VIPAnnouncerKubeVip,
+			wantAnnotations: map[string]string{utils.KeyKubevipLoadBalancerIP: ip, utils.KeyKubevipServiceInterface: iface},
+			// the label of the interface of the other announcers is removed
+			wantLabels: map[string]string{},
+		},
+		{
+			name:            "metallb",
+			announcer:       utils.VIPAnnouncerMetalLB,
+			wantAnnotations: map[string]string{utils.KeyMetalLBLoadBalancerIPs: ip, utils.KeyMetalLBAllowSharedIP: sharingKey},
+			wantLabels:      map[string]string{utils.LabelKeyServiceInterface: iface},
+		},
+		{
+			name:            "cilium",
+			announcer:       utils.VIPAnnouncerCilium,
+			wantAnnotations: map[string]string{utils.KeyCiliumLoadBalancerIPs: ip, utils.KeyCiliumSharingKey: sharingKey},
+			wantLabels:      map[string]string{utils.LabelKeyServiceInterface: iface},
+		},
+		{
+			name:            "none",
+			announcer:       utils.VIPAnnouncerNone,
+			wantAnnotations: map[string]string{utils.KeyLoadBalancerIPs: ip},
+			wantLabels:      map[string]string{utils.LabelKeyServiceInterface: iface},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			announcer, err := NewAnnouncer(tt.announcer)
+			if err != nil {
+				t.Fatalf("NewAnnouncer() error = %v", err)
+			}
+			// the service is annotated by other announcers before
+			svc := newServiceWithAnnotations(map[string]string{
+				utils.KeyKubevipLoadBalancerIP:   "192.168.100.1",
+				utils.KeyKubevipServiceInterface: "eth0",
+				utils.KeyMetalLBLoadBalancerIPs:  "192.168.100.1",
+				utils.KeyMetalLBAllowSharedIP:    "default.other",
+				utils.KeyCiliumSharingKey:        "default.other",
+			}, map[string]string{utils.LabelKeyServiceInterface: "eth0"})
+			if announcer.IsAnnounced(svc, ip, sharingKey) {
+				t.Errorf("IsAnnounced() = true before SetIPs()")
+			}
+
+			announcer.SetIPs(svc, ip, sharingKey)
+			if !announcer.IsAnnounced(svc, ip, sharingKey) {
+				t.Errorf("IsAnnounced() = false after SetIPs()")
+			}
+			announcer.SetInterface(svc, iface)
+			if diff := cmp.Diff(tt.wantAnnotations, svc.Annotations); diff != "" {
+				t.Errorf("annotations mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tt.wantLabels, svc.Labels); diff != "" {
+				t.Errorf("labels mismatch (-want +got):\n%s", diff)
+			}
+			if announcer.IPs(svc) != ip || announcer.Interface(svc) != iface {
+				t.Errorf("IPs() = %q, Interface() = %q, want %q and %q", announcer.IPs(svc), announcer.Interface(svc), ip, iface)
+			}
+
+			announcer.SetInterface(svc, "")
+			if got := announcer.Interface(svc); got != "" {
+				t.Errorf("Interface() = %q after removed", got)
+			}
+		})
+	}
+
+	if _, err := NewAnnouncer("keepalived"); err == nil {
+		t.Errorf("NewAnnouncer() of an unknown announcer succeeded")
+	}
+}
+
+func Test_stableLoadBalancerName(t *testing.T) {
+	const (
+		clusterName = "test"
+		ip          = "192.168.100.10"
+	)
+	svc := newLoadBalancerService()
+	svc.Annotations[utils.KeyStableLoadBalancerName] = "true"
+	lbClient := fakeclients.NewLoadBalancerClient()
+	svcClient := fakeclients.NewServiceClient(svc)
+	l := newFakeLoadBalancerManager(lbClient, svcClient)
+	l.retainStableLoadBalancers = true
+
+	// the name without the UID is pinned on the first creation
+	_, err := l.EnsureLoadBalancer(context.Background(), clusterName, svc, nil)
+	var retryErr *api.RetryError
+	if !goerrors.As(err, &retryErr) {
+		t.Fatalf("EnsureLoadBalancer() error = %v, want a retry error", err)
+	}
+	name := loadBalancerName(clusterName, svc.Namespace, svc.Name, "")
+	got, _ := svcClient.Get(svc.Namespace, svc.Name, metav1.GetOptions{})
+	if got.Annotations[utils.KeyLoadBalancerName] != name {
+		t.Fatalf("pinned names = %q, want %q", got.Annotations[utils.KeyLoadBalancerName], name)
+	}
+	lb, err := lbClient.Get(l.namespace, name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("load balancer %s is not created: %v", name, err)
+	}
+	lb.Status.AllocatedAddress.IP, lb.Status.Address = ip, ip
+	if _, err := lbClient.Update(lb); err != nil {
+		t.Fatal(err)
+	}
+
+	// the load balancer of the deleted service is retained
+	got.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+	if err := l.EnsureLoadBalancerDeleted(context.Background(), clusterName, got); err != nil {
+		t.Fatalf("EnsureLoadBalancerDeleted() error = %v", err)
+	}
+	if _, err := lbClient.Get(l.namespace, name, metav1.GetOptions{}); err != nil {
+		t.Fatalf("load balancer of the deleted service is not retained: %v", err)
+	}
+
+	// the recreated service adopts the load balancer and its address
+	if err := svcClient.Delete(svc.Namespace, svc.Name, nil); err != nil {
+		t.Fatal(err)
+	}
+	recreated := newLoadBalancerService()
+	recreated.UID = "recreated-uid"
+	recreated.Annotations[utils.KeyStableLoadBalancerName] = "true"
+	if recreated, err = svcClient.Create(recreated); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.EnsureLoadBalancer(context.Background(), clusterName, recreated, nil); err != nil {
+		t.Fatalf("EnsureLoadBalancer() of the recreated service error = %v", err)
+	}
+	lb, _ = lbClient.Get(l.namespace, name, metav1.GetOptions{})
+	if lb.Annotations[utils.AnnotationKeyServiceUIDOnLB] != string(recreated.UID) {
+		t.Errorf("load balancer is not adopted, owner UID = %s", lb.Annotations[utils.AnnotationKeyServiceUIDOnLB])
+	}
+	got, _ = svcClient.Get(recreated.Namespace, recreated.Name, metav1.GetOptions{})
+	if got.Annotations[utils.KeyKubevipLoadBalancerIP] != ip {
+		t.Errorf("address of the adopted load balancer = %q, want %q", got.Annotations[utils.KeyKubevipLoadBalancerIP], ip)
+	}
+
+	// another service carrying the same name can't take over a load balancer in use
+	other := newLoadBalancerService()
+	other.Name, other.UID = "other-svc", "other-uid"
+	other.Annotations[utils.KeyLoadBalancerName] = name
+	if other, err = svcClient.Create(other); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.EnsureLoadBalancer(context.Background(), clusterName, other, nil); err == nil || !strings.Contains(err.Error(), "owned by service") {
+		t.Errorf("EnsureLoadBalancer() error = %v, want a name conflict", err)
+	}
+
+	// nor a load balancer of another cluster
+	if _, err := l.EnsureLoadBalancer(context.Background(), "another", other, nil); err == nil || !strings.Contains(err.Error(), "belongs to cluster") {
+		t.Errorf("EnsureLoadBalancer() error = %v, want a name conflict", err)
+	}
+
+	// a load balancer without the owner UID is only used by the service it's labelled for
+	delete(lb.Annotations, utils.AnnotationKeyServiceUIDOnLB)
+	if _, err := lbClient.Update(lb); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.EnsureLoadBalancer(context.Background(), "another", other, nil); err == nil || !strings.Contains(err.Error(), "belongs to cluster") {
+		t.Errorf("EnsureLoadBalancer() of another cluster error = %v, want a name conflict", err)
+	}
+	if _, err := l.EnsureLoadBalancer(context.Background(), clusterName, other, nil); err == nil || !strings.Contains(err.Error(), "created for service") {
+		t.Errorf("EnsureLoadBalancer() error = %v, want a name conflict", err)
+	}
+	if err := l.claimLoadBalancer(name, lb, clusterName, recreated); err != nil {
+		t.Errorf("claimLoadBalancer() of the labelled service error = %v", err)
+	}
+}
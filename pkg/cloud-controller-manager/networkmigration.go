@@ -0,0 +1,151 @@
+package ccm
+
+import (
+	goerrors "errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	lbv1 "github.com/harvester/harvester-load-balancer/pkg/apis/loadbalancer.harvesterhci.io/v1beta1"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/cloud-provider/api"
+
+	utils "github.com/harvester/harvester-cloud-provider/pkg/utils"
+)
+
+const (
+	eventReasonNetworkMigrating = "NetworkMigrating"
+	eventReasonNetworkMigrated  = "NetworkMigrated"
+)
+
+// isNetworkMigrationAllowed reports whether the network annotation of the primary service can be changed after its load
+// balancers are created.
+func isNetworkMigrationAllowed(service *v1.Service) bool {
+	return service.Annotations[utils.KeyAllowNetworkMigration] == "true"
+}
+
+// migrationLoadBalancerName returns the name of the load balancer allocating the address of the family on the network.
+// The name is derived from the network, so that the migration can be resumed by the retries.
+func migrationLoadBalancerName(clusterName string, service *v1.Service, family v1.IPFamily, network string) string {
+	return loadBalancerName(clusterName, service.Namespace, service.Name,
+		string(service.UID)+"-"+strings.ToLower(string(family))+"-"+network)
+}
+
+// migrationTargets returns the load balancers on the network in the annotation of the service replacing the ones of
+// the same IP families.
+func migrationTargets(clusterName string, service *v1.Service, flbs []familyLoadBalancer) []familyLoadBalancer {
+	targets := make([]familyLoadBalancer, 0, len(flbs))
+	for _, flb := range flbs {
+		target := flb
+		target.name = migrationLoadBalancerName(clusterName, service, flb.family, service.Annotations[utils.KeyNetwork])
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// isNetworkMigrating reports whether any existing load balancer of the primary service is on another network than the
+// service asks for, the load balancers not existing are nil.
+func isNetworkMigrating(service *v1.Service, lbs []*lbv1.LoadBalancer) bool {
+	return slices.ContainsFunc(lbs, func(lb *lbv1.LoadBalancer) bool {
+		return lb != nil && IsNetworkChanged(service, lb)
+	})
+}
+
+// migrateNetwork moves the primary service to the network in its annotation without deleting it, its ports are checked
+// against the secondary services before:
+//  1. create the load balancers on the new network and wait for their addresses
+//  2. switch the annotations of the announcer to the new addresses
+//  3. record the new load balancers in the annotation KeyLoadBalancerName
+//  4. delete the old load balancers
+//  5. resync the secondary services with the new addresses and network
+//
+// The service keeps the old addresses until the new ones are allocated. Every step is idempotent, so the migration is
+// resumed by the retries.
+func (l *LoadBalancerManager) migrateNetwork(clusterName string, service *v1.Service, flbs []familyLoadBalancer, nodes []*v1.Node) (*v1.LoadBalancerStatus, error) {
+	network := service.Annotations[utils.KeyNetwork]
+	targets := migrationTargets(clusterName, service, flbs)
+	names := make([]string, 0, len(targets))
+	for _, target := range targets {
+		names = append(names, target.name)
+	}
+
+	started := false
+	lbs := make([]*lbv1.LoadBalancer, len(targets))
+	for i, target := range targets {
+		lb, err := l.getLoadBalancer(target.name)
+		if err != nil {
+			return nil, err
+		}
+		// the load balancers on the new network are claimed the same as the ones of the service on its network
+		if err := l.claimLoadBalancer(target.name, lb, clusterName, service); err != nil {
+			return nil, err
+		}
+		if err := l.checkAllocationRequest(service, clusterName, target, lb); err != nil {
+			return nil, err
+		}
+		started = started || lb == nil
+		if lbs[i], err = l.createOrUpdateLoadBalancer(target, lb, clusterName, service, nodes); err != nil {
+			return nil, fmt.Errorf("create or update lb %s/%s failed, error: %w", l.namespace, target.name, err)
+		}
+	}
+	// the event is recorded once when the load balancers on the new network are created, not on every retry
+	if started {
+		l.recordEvent(service, v1.EventTypeNormal, eventReasonNetworkMigrating,
+			"migrating to network %q, waiting for the addresses of load balancers %v", network, names)
+	}
+
+	ips, err := l.updatePrimaryServiceLoadBalancerIP(targets, lbs, service)
+	if err != nil {
+		if goerrors.Is(err, errAllocationPending) {
+			return nil, api.NewRetryError(err.Error(), pendingRetryInterval)
+		}
+		return nil, fmt.Errorf("update load balancer IP of service %s/%s failed, error: %w", service.Namespace, service.Name, err)
+	}
+
+	if err := l.updateService(service, func(svc *v1.Service) {
+		if svc.Annotations == nil {
+			svc.Annotations = make(map[string]string)
+		}
+		svc.Annotations[utils.KeyLoadBalancerName] = strings.Join(names, ",")
+	}); err != nil {
+		return nil, fmt.Errorf("switch load balancers of service %s/%s failed: %w", service.Namespace, service.Name, err)
+	}
+
+	for _, flb := range flbs {
+		if err := l.deleteLoadBalancerByName(flb.name, service); err != nil {
+			return nil, fmt.Errorf("delete lb %s/%s on the former network failed: %w", l.namespace, flb.name, err)
+		}
+	}
+
+	if err := l.resyncSecondaryServices(service); err != nil {
+		return nil, err
+	}
+
+	logrus.Infof("service %s/%s is migrated to network %q with load balancers %v", service.Namespace, service.Name, network, names)
+	l.recordEvent(service, v1.EventTypeNormal, eventReasonNetworkMigrated,
+		"migrated to network %q with load balancers %v", network, names)
+
+	return l.loadBalancerStatus(clusterName, service, ips)
+}
+
+// resyncSecondaryServices updates the secondary services with the addresses and network of the primary service.
+func (l *LoadBalancerManager) resyncSecondaryServices(primary *v1.Service) error {
+	latest, err := l.localSvcClient.Get(primary.Namespace, primary.Name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("get primary service %s/%s failed: %w", primary.Namespace, primary.Name, err)
+	}
+
+	secondaries, err := l.listSecondaryServices(latest)
+	if err != nil {
+		return err
+	}
+	for _, svc := range secondaries {
+		if err := l.updateSecondaryServiceLoadBalancerIP(l.announcer.IPs(latest), latest, svc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,260 @@
+package ccm
+
+import (
+	"encoding/json"
+	goerrors "errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+
+	utils "github.com/harvester/harvester-cloud-provider/pkg/utils"
+)
+
+const eventReasonPortConflict = "PortConflict"
+
+// portReservations maps the ports "<protocol>/<port>" of the secondary services to their owners "<namespace>/<name>".
+type portReservations map[string]string
+
+// portKey identifies a port shared on the addresses of the primary service, the same number can be used by different
+// protocols, e.g. DNS over TCP 53 and UDP 53.
+type portKey struct {
+	protocol v1.Protocol
+	port     int32
+}
+
+// newPortKey returns the key of the service port, the protocol defaults to TCP like the API server does.
+func newPortKey(port v1.ServicePort) portKey {
+	protocol := port.Protocol
+	if protocol == "" {
+		protocol = v1.ProtocolTCP
+	}
+	return portKey{protocol: protocol, port: port.Port}
+}
+
+// String returns the key of the port in the port reservations.
+func (k portKey) String() string {
+	return string(k.protocol) + "/" + strconv.Itoa(int(k.port))
+}
+
+func servicePortKeys(service *v1.Service) []string {
+	keys := make([]string, 0, len(service.Spec.Ports))
+	for _, port := range service.Spec.Ports {
+		keys = append(keys, newPortKey(port).String())
+	}
+	return keys
+}
+
+// portConflict is a port of the service used by another service sharing the addresses.
+type portConflict struct {
+	port  string
+	owner string
+}
+
+// portConflictError lists every port of the service used by the other services sharing the addresses.
+type portConflictError struct {
+	service   string
+	conflicts []portConflict
+}
+
+func (e *portConflictError) Error() string {
+	conflicts := make([]string, 0, len(e.conflicts))
+	for _, c := range e.conflicts {
+		conflicts = append(conflicts, c.port+" used by "+c.owner)
+	}
+	return fmt.Sprintf("ports of service %s conflict: %s", e.service, strings.Join(conflicts, ", "))
+}
+
+// reservePorts reserves the ports of the secondary service on the primary service. The reservations are written with
+// the resource version of the primary service, so only one of the secondary services claiming the same port at the
+// same time succeeds, and the others see the reservation on retry.
+func (l *LoadBalancerManager) reservePorts(primary, secondary *v1.Service) error {
+	owner := secondary.Namespace + "/" + secondary.Name
+	ports := servicePortKeys(secondary)
+
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		// read from the API server instead of the cache, a stale primary service only leads to conflicts
+		latest, err := l.localSvcClient.Get(primary.Namespace, primary.Name, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("get primary service %s/%s failed: %w", primary.Namespace, primary.Name, err)
+		}
+		if latest.UID != primary.UID {
+			return fmt.Errorf("primary service %s/%s has been recreated", primary.Namespace, primary.Name)
+		}
+
+		reservations, err := l.getPortReservations(latest)
+		if err != nil {
+			return err
+		}
+		updated := maps.Clone(reservations)
+		// release the ports the secondary service doesn't use any longer
+		maps.DeleteFunc(updated, func(port, reservedBy string) bool {
+			return reservedBy == owner && !slices.Contains(ports, port)
+		})
+
+		primaryPorts := servicePortKeys(latest)
+		conflictErr := &portConflictError{service: owner}
+		for _, port := range ports {
+			if slices.Contains(primaryPorts, port) {
+				conflictErr.conflicts = append(conflictErr.conflicts, portConflict{port: port, owner: latest.Namespace + "/" + latest.Name})
+				continue
+			}
+			if reservedBy, ok := updated[port]; ok && reservedBy != owner {
+				held, err := l.isPortReservationHeld(latest, reservedBy)
+				if err != nil {
+					return err
+				}
+				if held {
+					conflictErr.conflicts = append(conflictErr.conflicts, portConflict{port: port, owner: reservedBy})
+					continue
+				}
+			}
+			updated[port] = owner
+		}
+		if len(conflictErr.conflicts) > 0 {
+			return conflictErr
+		}
+
+		if maps.Equal(updated, reservations) && latest.Annotations[utils.KeyPortReservations] != "" {
+			return nil
+		}
+		return l.setPortReservations(latest, updated)
+	})
+}
+
+// checkPrimaryPorts checks the ports of the primary service against the ports reserved by its secondary services, the
+// same as the ports of a secondary service are checked. Without the reservations, e.g. before any secondary service
+// reserves its ports after an upgrade, the ports of the current secondary services are checked.
+func (l *LoadBalancerManager) checkPrimaryPorts(primary *v1.Service) error {
+	reservations, err := l.getPortReservations(primary)
+	if err != nil {
+		return err
+	}
+
+	conflictErr := &portConflictError{service: primary.Namespace + "/" + primary.Name}
+	for _, port := range servicePortKeys(primary) {
+		reservedBy, ok := reservations[port]
+		if !ok {
+			continue
+		}
+		held, err := l.isPortReservationHeld(primary, reservedBy)
+		if err != nil {
+			return err
+		}
+		if held {
+			conflictErr.conflicts = append(conflictErr.conflicts, portConflict{port: port, owner: reservedBy})
+		}
+	}
+	if len(conflictErr.conflicts) > 0 {
+		return conflictErr
+	}
+
+	return nil
+}
+
+// releasePorts removes the reservations of the secondary service leaving the primary service.
+func (l *LoadBalancerManager) releasePorts(primary, secondary *v1.Service) error {
+	owner := secondary.Namespace + "/" + secondary.Name
+
+	err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		latest, err := l.localSvcClient.Get(primary.Namespace, primary.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if latest.UID != primary.UID || latest.Annotations[utils.KeyPortReservations] == "" {
+			return nil
+		}
+
+		reservations, err := l.getPortReservations(latest)
+		if err != nil {
+			return err
+		}
+		updated := maps.Clone(reservations)
+		maps.DeleteFunc(updated, func(_, reservedBy string) bool { return reservedBy == owner })
+		if maps.Equal(updated, reservations) {
+			return nil
+		}
+		return l.setPortReservations(latest, updated)
+	})
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("release ports of service %s from primary service %s/%s failed: %w", owner, primary.Namespace, primary.Name, err)
+	}
+
+	return nil
+}
+
+// getPortReservations parses the port reservations of the primary service. The primary services whose secondary
+// services are attached before the reservations are introduced are initialized from the listed secondary services.
+func (l *LoadBalancerManager) getPortReservations(primary *v1.Service) (portReservations, error) {
+	reservations := make(portReservations)
+	if value := primary.Annotations[utils.KeyPortReservations]; value != "" {
+		err := json.Unmarshal([]byte(value), &reservations)
+		if err == nil {
+			return reservations, nil
+		}
+		logrus.Warnf("port reservations of primary service %s/%s are malformed, rebuild them: %v", primary.Namespace, primary.Name, err)
+		reservations = make(portReservations)
+	}
+
+	secondaries, err := l.listSecondaryServices(primary)
+	if err != nil {
+		return nil, fmt.Errorf("list secondary services of %s/%s failed: %w", primary.Namespace, primary.Name, err)
+	}
+	for _, svc := range secondaries {
+		for _, port := range servicePortKeys(svc) {
+			reservations[port] = svc.Namespace + "/" + svc.Name
+		}
+	}
+
+	return reservations, nil
+}
+
+func (l *LoadBalancerManager) setPortReservations(primary *v1.Service, reservations portReservations) error {
+	primaryCopy := primary.DeepCopy()
+	if primaryCopy.Annotations == nil {
+		primaryCopy.Annotations = make(map[string]string)
+	}
+	// the keys of a map are sorted by json.Marshal, so the value is stable
+	value, err := json.Marshal(reservations)
+	if err != nil {
+		return err
+	}
+	primaryCopy.Annotations[utils.KeyPortReservations] = string(value)
+
+	_, err = l.localSvcClient.Update(primaryCopy)
+	return err
+}
+
+// isPortReservationHeld reports whether the owner of a reservation is still a secondary service of the primary service.
+// The reservations of the deleted services or the services moved to other primary services are stale. The owner is read
+// from the cache, a stale owner only fails the check until the cache catches up.
+func (l *LoadBalancerManager) isPortReservationHeld(primary *v1.Service, owner string) (bool, error) {
+	namespace, name, ok := strings.Cut(owner, "/")
+	if !ok {
+		return false, nil
+	}
+	svc, err := l.localSvcCache.Get(namespace, name)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("get service %s failed: %w", owner, err)
+	}
+
+	return svc.Annotations[utils.KeyPrimaryService] == primary.Namespace+"/"+primary.Name, nil
+}
+
+// recordPortConflict records a warning event listing the conflicting ports on the service.
+func (l *LoadBalancerManager) recordPortConflict(service *v1.Service, err error) {
+	var conflictErr *portConflictError
+	if goerrors.As(err, &conflictErr) {
+		l.recordEvent(service, v1.EventTypeWarning, eventReasonPortConflict, "%s", conflictErr.Error())
+	}
+}
@@ -0,0 +1,219 @@
+package ccm
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	utils "github.com/harvester/harvester-cloud-provider/pkg/utils"
+)
+
+const (
+	eventReasonSecondaryServicePromoted = "SecondaryServicePromoted"
+	eventReasonPromotedToPrimary        = "PromotedToPrimaryService"
+)
+
+// isPromotionEnabled reports whether a secondary service takes over the load balancer when the primary service is
+// deleted.
+func isPromotionEnabled(primary *v1.Service) bool {
+	return primary.Annotations[utils.KeyPromoteOnPrimaryDelete] == "true"
+}
+
+// promoteSecondaryService hands over the load balancers of the primary service being deleted to one of its secondary
+// services, so that the address is kept. The other secondary services are moved to the promoted service.
+//
+// It returns false if there is no secondary service to promote. Every step is idempotent, if any of them fails, the
+// promoted service is found by the owner of the load balancer in the next retry.
+func (l *LoadBalancerManager) promoteSecondaryService(clusterName string, primary *v1.Service) (bool, error) {
+	flbs := getFamilyLoadBalancers(clusterName, primary)
+	names := make([]string, 0, len(flbs))
+	for _, flb := range flbs {
+		names = append(names, flb.name)
+	}
+
+	promoted, err := l.getPromotedService(primary, names[0])
+	if err != nil {
+		return false, err
+	}
+
+	secondaries, err := l.listSecondaryServices(primary)
+	if err != nil {
+		return false, err
+	}
+	if promoted == nil {
+		if promoted = pickServiceToPromote(clusterName, primary, secondaries); promoted == nil {
+			if len(secondaries) > 0 {
+				logrus.Infof("none of the secondary services of %s/%s has the same ip families %v, the load balancers are not handed over",
+					primary.Namespace, primary.Name, loadBalancerFamilies(clusterName, primary))
+			}
+			return false, nil
+		}
+	}
+
+	// 1. hand over the load balancers, the owner is recorded at first to find the promoted service in the retries
+	for _, name := range names {
+		if err := l.handOverLoadBalancer(name, promoted); err != nil {
+			return false, err
+		}
+	}
+
+	// 2. promote the secondary service with the allocation requests of the primary service, it must be the same as the
+	// load balancers, otherwise the ensuring of the promoted service fails
+	reservations, err := l.getPortReservations(primary)
+	if err != nil {
+		return false, err
+	}
+	maps.DeleteFunc(reservations, func(_, reservedBy string) bool { return reservedBy == promoted.Namespace+"/"+promoted.Name })
+	reservationsValue, err := json.Marshal(reservations)
+	if err != nil {
+		return false, err
+	}
+	if err := l.updateService(promoted, func(svc *v1.Service) {
+		delete(svc.Annotations, utils.KeyPrimaryService)
+		svc.Annotations[utils.KeyLoadBalancerName] = strings.Join(names, ",")
+		for _, key := range []string{utils.KeyIPAM, utils.KeyNetwork, utils.KeyProject, utils.KeyNamespace, utils.KeyIPPool} {
+			if value, ok := primary.Annotations[key]; ok {
+				svc.Annotations[key] = value
+			} else {
+				delete(svc.Annotations, key)
+			}
+		}
+		// the ports of the other secondary services stay reserved on the promoted service
+		if len(reservations) > 0 {
+			svc.Annotations[utils.KeyPortReservations] = string(reservationsValue)
+		} else {
+			delete(svc.Annotations, utils.KeyPortReservations)
+		}
+		if svc.Labels == nil {
+			svc.Labels = make(map[string]string)
+		}
+		svc.Labels[utils.KeyPrimaryService] = ""
+	}); err != nil {
+		return false, fmt.Errorf("promote service %s/%s failed: %w", promoted.Namespace, promoted.Name, err)
+	}
+
+	// 3. move the other secondary services to the promoted service
+	for _, svc := range secondaries {
+		if svc.UID == promoted.UID {
+			continue
+		}
+		if err := l.updateService(svc, func(svc *v1.Service) {
+			svc.Annotations[utils.KeyPrimaryService] = promoted.Namespace + "/" + promoted.Name
+			svc.Labels[utils.KeyPrimaryService] = primaryServiceLabelValue(promoted)
+		}); err != nil {
+			return false, fmt.Errorf("move secondary service %s/%s to %s/%s failed: %w", svc.Namespace, svc.Name, promoted.Namespace, promoted.Name, err)
+		}
+	}
+
+	// 4. release the primary service
+	if err := l.updateFinalizer(primary, func(finalizers []string) []string {
+		return slices.DeleteFunc(finalizers, func(f string) bool { return f == utils.FinalizerSecondaryServices })
+	}); err != nil {
+		return false, err
+	}
+
+	logrus.Infof("service %s/%s is promoted to take over the load balancers %v of the deleted primary service %s/%s",
+		promoted.Namespace, promoted.Name, names, primary.Namespace, primary.Name)
+	l.recordEvent(primary, v1.EventTypeNormal, eventReasonSecondaryServicePromoted,
+		"load balancers %v are handed over to service %s/%s", names, promoted.Namespace, promoted.Name)
+	l.recordEvent(promoted, v1.EventTypeNormal, eventReasonPromotedToPrimary,
+		"promoted to the primary service to take over the load balancers %v of the deleted service %s/%s", names, primary.Namespace, primary.Name)
+
+	return true, nil
+}
+
+// getPromotedService returns the service the load balancer has been handed over to by a former try, or nil.
+func (l *LoadBalancerManager) getPromotedService(primary *v1.Service, lbName string) (*v1.Service, error) {
+	lb, err := l.lbClient.Get(l.namespace, lbName, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	uid := lb.Annotations[utils.AnnotationKeyServiceUIDOnLB]
+	if uid == "" || uid == string(primary.UID) {
+		return nil, nil
+	}
+
+	svc, err := l.localSvcCache.Get(lb.Labels[utils.LBServiceNamespaceKey], lb.Labels[utils.LBServiceNameKey])
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if string(svc.UID) != uid {
+		return nil, nil
+	}
+
+	return svc, nil
+}
+
+func (l *LoadBalancerManager) handOverLoadBalancer(name string, promoted *v1.Service) error {
+	lb, err := l.lbClient.Get(l.namespace, name, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	lbCopy := lb.DeepCopy()
+	if lbCopy.Annotations == nil {
+		lbCopy.Annotations = make(map[string]string)
+	}
+	if lbCopy.Labels == nil {
+		lbCopy.Labels = make(map[string]string)
+	}
+	lbCopy.Annotations[utils.AnnotationKeyServiceUIDOnLB] = string(promoted.UID)
+	lbCopy.Labels[utils.LBServiceNamespaceKey] = promoted.Namespace
+	lbCopy.Labels[utils.LBServiceNameKey] = promoted.Name
+	if _, err := l.lbClient.Update(lbCopy); err != nil {
+		return fmt.Errorf("hand over lb %s/%s to service %s/%s failed: %w", lb.Namespace, lb.Name, promoted.Namespace, promoted.Name, err)
+	}
+
+	return nil
+}
+
+// pickServiceToPromote prefers the secondary services with the annotation KeyPromoteOnPrimaryDelete, and the oldest
+// one of them. Only the secondary services with the same IP families as the primary service are candidates, otherwise
+// the promoted service would delete the load balancer of the family it doesn't have. It returns nil without candidates.
+func pickServiceToPromote(clusterName string, primary *v1.Service, secondaries []*v1.Service) *v1.Service {
+	families := loadBalancerFamilies(clusterName, primary)
+	candidates := slices.DeleteFunc(slices.Clone(secondaries), func(svc *v1.Service) bool {
+		// the promoted service inherits the ip pools of the primary service
+		promoted := svc.DeepCopy()
+		if promoted.Annotations == nil {
+			promoted.Annotations = make(map[string]string)
+		}
+		promoted.Annotations[utils.KeyIPPool] = primary.Annotations[utils.KeyIPPool]
+		return !slices.Equal(loadBalancerFamilies(clusterName, promoted), families)
+	})
+	if len(candidates) == 0 {
+		return nil
+	}
+	slices.SortStableFunc(candidates, func(a, b *v1.Service) int {
+		preferredA, preferredB := isPromotionEnabled(a), isPromotionEnabled(b)
+		if preferredA != preferredB {
+			if preferredA {
+				return -1
+			}
+			return 1
+		}
+		if c := a.CreationTimestamp.Compare(b.CreationTimestamp.Time); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Namespace+"/"+a.Name, b.Namespace+"/"+b.Name)
+	})
+
+	return candidates[0]
+}
@@ -0,0 +1,125 @@
+package ccm
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	lbv1 "github.com/harvester/harvester-load-balancer/pkg/apis/loadbalancer.harvesterhci.io/v1beta1"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	utils "github.com/harvester/harvester-cloud-provider/pkg/utils"
+)
+
+const (
+	eventReasonLoadBalancerAdopted      = "LoadBalancerAdopted"
+	eventReasonLoadBalancerNameConflict = "LoadBalancerNameConflict"
+)
+
+// isStableNameEnabled reports whether the names of the load balancers of the service are kept in the annotation
+// KeyLoadBalancerName instead of being derived from the UID of the service.
+func isStableNameEnabled(service *v1.Service) bool {
+	return service.Annotations[utils.KeyStableLoadBalancerName] == "true"
+}
+
+// stableLoadBalancerName returns the name of the load balancer of the IP family without the UID of the service, so that
+// the recreated service gets the same name. The first family has no suffix like the single stack load balancer.
+func stableLoadBalancerName(clusterName string, service *v1.Service, index int, family v1.IPFamily) string {
+	if index == 0 {
+		return loadBalancerName(clusterName, service.Namespace, service.Name, "")
+	}
+	return loadBalancerName(clusterName, service.Namespace, service.Name, strings.ToLower(string(family)))
+}
+
+// pinLoadBalancerNames writes the stable names of the load balancers into the annotation KeyLoadBalancerName on the
+// first creation, and when the second IP family is added. The names in the annotation are kept, so the load balancers
+// survive the renaming of the cluster, and a service carrying the same names adopts the load balancers. The service with
+// the pinned names is returned.
+func (l *LoadBalancerManager) pinLoadBalancerNames(clusterName string, service *v1.Service) (*v1.Service, error) {
+	names := loadBalancerNameOverrides(service)
+	flbs := getFamilyLoadBalancers(clusterName, service)
+
+	pinned := slices.Clone(names)
+	for i := len(pinned); i < len(flbs); i++ {
+		pinned = append(pinned, stableLoadBalancerName(clusterName, service, i, flbs[i].family))
+	}
+	if len(pinned) == len(names) {
+		return service, nil
+	}
+	value := strings.Join(pinned, ",")
+
+	if err := l.updateService(service, func(svc *v1.Service) {
+		if svc.Annotations == nil {
+			svc.Annotations = make(map[string]string)
+		}
+		svc.Annotations[utils.KeyLoadBalancerName] = value
+	}); err != nil {
+		return nil, fmt.Errorf("pin load balancer names %v of service %s/%s failed: %w", pinned, service.Namespace, service.Name, err)
+	}
+
+	pinnedService := service.DeepCopy()
+	if pinnedService.Annotations == nil {
+		pinnedService.Annotations = make(map[string]string)
+	}
+	pinnedService.Annotations[utils.KeyLoadBalancerName] = value
+
+	return pinnedService, nil
+}
+
+// claimLoadBalancer checks the existing load balancer of the name can be used by the service. The load balancer of a
+// deleted service in the same cluster is adopted together with its address, while the one still owned by another
+// service or created by another cluster is a conflict. The load balancer without the UID of its service is only used by
+// the service it's labelled for. lb is nil if the load balancer doesn't exist.
+func (l *LoadBalancerManager) claimLoadBalancer(name string, lb *lbv1.LoadBalancer, clusterName string, service *v1.Service) error {
+	if lb == nil {
+		return nil
+	}
+
+	owner := lb.Labels[utils.LBServiceNamespaceKey] + "/" + lb.Labels[utils.LBServiceNameKey]
+	if cluster := lb.Labels[utils.LBClusterNameKey]; cluster != clusterName {
+		return l.loadBalancerNameConflict(service, name, fmt.Sprintf("it belongs to cluster %q", cluster))
+	}
+
+	uid := lb.Annotations[utils.AnnotationKeyServiceUIDOnLB]
+	if uid == "" {
+		// the load balancer created before the UID was recorded is only claimed by the service it's labelled for
+		if owner != service.Namespace+"/"+service.Name {
+			return l.loadBalancerNameConflict(service, name, fmt.Sprintf("it is created for service %s", owner))
+		}
+		return nil
+	}
+	if uid == string(service.UID) {
+		return nil
+	}
+
+	svc, err := l.localSvcClient.Get(lb.Labels[utils.LBServiceNamespaceKey], lb.Labels[utils.LBServiceNameKey], metav1.GetOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("get owner %s of lb %s/%s failed: %w", owner, l.namespace, name, err)
+	}
+	if err == nil && string(svc.UID) == uid {
+		return l.loadBalancerNameConflict(service, name, fmt.Sprintf("it is owned by service %s", owner))
+	}
+
+	// the address is kept as the load balancer is updated instead of being recreated
+	logrus.Infof("service %s/%s adopts lb %s/%s with address %s of the deleted service %s", service.Namespace, service.Name,
+		l.namespace, name, lb.Status.AllocatedAddress.IP, owner)
+	l.recordEvent(service, v1.EventTypeNormal, eventReasonLoadBalancerAdopted,
+		"adopted load balancer %s/%s with address %s of the deleted service %s", l.namespace, name, lb.Status.AllocatedAddress.IP, owner)
+
+	return nil
+}
+
+func (l *LoadBalancerManager) loadBalancerNameConflict(service *v1.Service, name, reason string) error {
+	l.recordEvent(service, v1.EventTypeWarning, eventReasonLoadBalancerNameConflict,
+		"load balancer %s/%s can't be used, %s", l.namespace, name, reason)
+	return fmt.Errorf("load balancer %s/%s of service %s/%s can't be used, %s", l.namespace, name, service.Namespace, service.Name, reason)
+}
+
+// isLoadBalancerRetained reports whether the load balancers of the deleted service are kept for a recreated service to
+// adopt. They are deleted by the garbage collection if not adopted within the grace period.
+func (l *LoadBalancerManager) isLoadBalancerRetained(service *v1.Service) bool {
+	return l.retainStableLoadBalancers && service.DeletionTimestamp != nil && isStableNameEnabled(service)
+}
@@ -0,0 +1,59 @@
+package ccm
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+
+	utils "github.com/harvester/harvester-cloud-provider/pkg/utils"
+)
+
+// loadBalancerStatus returns the status the service controller writes into the service. By default, it's left to
+// kube-vip, which fills in the ingresses from the annotation kube-vip.io/loadbalancerIPs. With the direct status, the
+// ingresses are built from the allocated addresses, so that the status is correct with other VIP agents or none.
+//
+// The address of the IPAM mode dhcp is the unspecified address 0.0.0.0, kube-vip leases the address from the DHCP
+// server in the guest cluster and fills in the status, so the status is left to kube-vip even with the direct status.
+func (l *LoadBalancerManager) loadBalancerStatus(clusterName string, service *v1.Service, ips []string) (*v1.LoadBalancerStatus, error) {
+	if !l.directStatus || slices.ContainsFunc(ips, isUnspecifiedIP) {
+		return &service.Status.LoadBalancer, nil
+	}
+
+	var hostname string
+	if l.hostnameTemplate != nil {
+		var b strings.Builder
+		if err := l.hostnameTemplate.Execute(&b, utils.LoadBalancerHostname{
+			Name:        service.Name,
+			Namespace:   service.Namespace,
+			ClusterName: clusterName,
+		}); err != nil {
+			return nil, fmt.Errorf("build hostname of service %s/%s failed: %w", service.Namespace, service.Name, err)
+		}
+		hostname = b.String()
+	}
+
+	status := &v1.LoadBalancerStatus{Ingress: make([]v1.LoadBalancerIngress, 0, len(ips)+1)}
+	for _, ip := range ips {
+		ingress := v1.LoadBalancerIngress{IP: ip}
+		if l.ipMode != "" {
+			ipMode := l.ipMode
+			ingress.IPMode = &ipMode
+		}
+		status.Ingress = append(status.Ingress, ingress)
+	}
+	// the hostname is a separate ingress, it would be repeated in the ingress of every IP family otherwise
+	if hostname != "" {
+		status.Ingress = append(status.Ingress, v1.LoadBalancerIngress{Hostname: hostname})
+	}
+
+	return status, nil
+}
+
+// isUnspecifiedIP reports whether the address is the placeholder allocated by the IPAM mode dhcp.
+func isUnspecifiedIP(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	return err == nil && addr.IsUnspecified()
+}
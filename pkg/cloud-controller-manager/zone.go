@@ -0,0 +1,146 @@
+package ccm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	cloudprovider "k8s.io/cloud-provider"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+const (
+	// envNodeName is the name of the guest node the cloud provider runs on, it's set by the downward API.
+	envNodeName = "NODE_NAME"
+	// hostTopologyTTL is how long the topology of a Harvester host is cached, the hosts are rarely relabelled.
+	hostTopologyTTL = 5 * time.Minute
+)
+
+// hostTopology is the cached topology of a Harvester host.
+type hostTopology struct {
+	region, zone       string
+	hasRegion, hasZone bool
+	expires            time.Time
+}
+
+// GetZone returns the zone of the guest node the cloud provider runs on.
+func (i *instanceManager) GetZone(ctx context.Context) (cloudprovider.Zone, error) {
+	nodeName := os.Getenv(envNodeName)
+	if nodeName == "" {
+		return cloudprovider.Zone{}, fmt.Errorf("the environment variable %s is not set, the node the cloud provider runs on is unknown", envNodeName)
+	}
+	return i.GetZoneByNodeName(ctx, types.NodeName(nodeName))
+}
+
+// GetZoneByProviderID returns the zone of the guest node by its provider ID harvester://<vm-uid>.
+func (i *instanceManager) GetZoneByProviderID(_ context.Context, providerID string) (cloudprovider.Zone, error) {
+	vm, err := i.getVMByProviderID(providerID)
+	if err != nil {
+		return cloudprovider.Zone{}, err
+	}
+	return i.getZoneOfVM(vm.Name)
+}
+
+// GetZoneByNodeName returns the zone of the guest node by its name.
+func (i *instanceManager) GetZoneByNodeName(_ context.Context, nodeName types.NodeName) (cloudprovider.Zone, error) {
+	vm, err := i.getVMByNodeName(string(nodeName))
+	if err != nil {
+		return cloudprovider.Zone{}, err
+	}
+	return i.getZoneOfVM(vm.Name)
+}
+
+func (i *instanceManager) getZoneOfVM(vmName string) (cloudprovider.Zone, error) {
+	vmi, err := i.vmiClient.Get(i.namespace, vmName, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return cloudprovider.Zone{}, nil
+		}
+		return cloudprovider.Zone{}, err
+	}
+	return i.getTopology(vmi), nil
+}
+
+// getTopology returns the region and zone of the guest node. They are read from the topology labels of the Harvester
+// host the VMI runs on, so that they follow the VMI migrated to another host. The annotations of the VMI are the
+// fallback, e.g. when the host has no topology labels or can't be read.
+//
+// The hosts are cluster-scoped, the Harvester account of the cloud provider may not be permitted to read them. The
+// lookup is disabled once it's forbidden, so the annotations of the VMIs are used without retrying on every call.
+func (i *instanceManager) getTopology(vmi *kubevirtv1.VirtualMachineInstance) cloudprovider.Zone {
+	zone := cloudprovider.Zone{
+		Region:        vmi.Annotations[v1.LabelTopologyRegion],
+		FailureDomain: vmi.Annotations[v1.LabelTopologyZone],
+	}
+	if i.hostClient == nil || vmi.Status.NodeName == "" || i.hostLookupForbidden.Load() {
+		return zone
+	}
+
+	host, err := i.getHostTopology(vmi.Status.NodeName)
+	if err != nil {
+		if errors.IsForbidden(err) {
+			if i.hostLookupForbidden.CompareAndSwap(false, true) {
+				logrus.Warnf("the Harvester account is not permitted to get the hosts, the topology is read from the annotations of the VMIs from now on: %v", err)
+			}
+			return zone
+		}
+		logrus.Warnf("get Harvester host %s of VMI %s/%s failed, fall back to the topology annotations of the VMI: %v",
+			vmi.Status.NodeName, vmi.Namespace, vmi.Name, err)
+		return zone
+	}
+	if host.hasRegion {
+		zone.Region = host.region
+	}
+	if host.hasZone {
+		zone.FailureDomain = host.zone
+	}
+
+	return zone
+}
+
+// getHostTopology returns the topology labels of the Harvester host, they are cached for hostTopologyTTL.
+func (i *instanceManager) getHostTopology(hostName string) (*hostTopology, error) {
+	if cached, ok := i.hostTopologies.Load(hostName); ok && time.Now().Before(cached.(*hostTopology).expires) {
+		return cached.(*hostTopology), nil
+	}
+
+	host, err := i.hostClient.Get(hostName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	topology := &hostTopology{expires: time.Now().Add(hostTopologyTTL)}
+	topology.region, topology.hasRegion = host.Labels[v1.LabelTopologyRegion]
+	topology.zone, topology.hasZone = host.Labels[v1.LabelTopologyZone]
+	i.hostTopologies.Store(hostName, topology)
+
+	return topology, nil
+}
+
+// getVMByProviderID returns the VM whose UID is in the provider ID harvester://<vm-uid>.
+func (i *instanceManager) getVMByProviderID(providerID string) (*kubevirtv1.VirtualMachine, error) {
+	uid, ok := strings.CutPrefix(providerID, ProviderName+"://")
+	if !ok || uid == "" {
+		return nil, fmt.Errorf("invalid provider ID %q, it must be %s://<vm-uid>", providerID, ProviderName)
+	}
+
+	// a VM missing from the cache being synced isn't gone, the node would be deleted otherwise
+	if i.vmSynced != nil && !i.vmSynced() {
+		return nil, fmt.Errorf("the cache of the VMs is not synced yet, the VM of provider ID %s is unknown", providerID)
+	}
+	vms, err := i.vmCache.GetByIndex(indexVMByUID, uid)
+	if err != nil {
+		return nil, err
+	}
+	if len(vms) == 0 {
+		return nil, errors.NewNotFound(kubevirtv1.Resource("virtualmachines"), uid)
+	}
+
+	return vms[0], nil
+}
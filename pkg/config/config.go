@@ -21,6 +21,7 @@ package config
 import (
 	"net/netip"
 	"strings"
+	"time"
 	// NOTE: To prevent circular dependencies, DO NOT import
 	// "github.com/harvester/harvester-cloud-provider/pkg/utils" here,
 	// as that package already imports this config package.
@@ -45,6 +46,19 @@ type Config struct {
 	DisableVMIController bool
 	ShowFullHelpOnError  bool
 
+	LoadBalancerGCInterval    time.Duration
+	LoadBalancerGCGracePeriod time.Duration
+	LoadBalancerGCDryRun      bool
+
+	// LoadBalancerDirectStatus makes the cloud provider return the load balancer status built from the allocated
+	// addresses, LoadBalancerIPMode and LoadBalancerHostnameTemplate only take effect with it.
+	LoadBalancerDirectStatus     bool
+	LoadBalancerIPMode           string
+	LoadBalancerHostnameTemplate string
+
+	// VIPAnnouncer is the agent announcing the addresses of the load balancers, e.g. kube-vip
+	VIPAnnouncer string
+
 	// internalNodeIPCIDRPrefixes is the pre-parsed representation of NodeIPCIDR.
 	// NOTE: This is populated during bootstrap validation. By storing the
 	// parsed prefixes here, we ensure that the rest of the application
@@ -4,7 +4,9 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"sync"
+	"time"
 
 	cfg "github.com/harvester/harvester-cloud-provider/pkg/config"
 	utils "github.com/harvester/harvester-cloud-provider/pkg/utils"
@@ -17,6 +19,7 @@ import (
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/util/retry"
 	cloudproviderapi "k8s.io/cloud-provider/api"
@@ -27,11 +30,20 @@ import (
 
 const (
 	vmiControllerName = "harvester-cloudprovider-resync-topology"
+
+	// resyncWorkers bounds the concurrent requests to the guest agents when the node-to-VM mapping is rebuilt
+	resyncWorkers = 8
 )
 
+// guestOsInfoTimeout bounds a request to the guest agent, the VMI falls back to its name as the node name after it.
+// It's a variable to be shortened by the unit tests.
+var guestOsInfoTimeout = 10 * time.Second
+
 // Register the controller is helping to re-sync harvester node topology labels to guest cluster nodes.
 // when the migration is completed, the controller will re-sync the labels to guest cluster nodes.
 // this is to make sure the node topology labels are always up-to-date.
+// The node-to-VM mapping is rebuilt from the guest agents before it returns, so it must be called before the node
+// controllers run. It's kept up-to-date on every change of the VMIs afterwards.
 func Register(
 	ctx context.Context,
 	restClient kubernetes.Interface,
@@ -43,8 +55,10 @@ func Register(
 	namespace string,
 ) {
 	handler := &Handler{
+		ctx:             ctx,
 		vmis:            vmis,
 		vmiCache:        vmis.Cache(),
+		nodeClient:      nodes,
 		nodeCache:       nodes.Cache(),
 		configMapClient: configMaps,
 		restClient:      restClient,
@@ -56,31 +70,57 @@ func Register(
 		"controller": vmiControllerName,
 		"namespace":  namespace,
 	}).Info("start watching virtual machine instance")
+	handler.resyncNodeToVMName(ctx)
 	vmis.OnChange(ctx, vmiControllerName, handler.OnVmiChanged)
 }
 
 type Handler struct {
-	vmis            ctlv1.VirtualMachineInstanceController
+	// ctx is cancelled when the cloud provider stops, it bounds the requests to the guest agents
+	ctx             context.Context
+	vmis            ctlv1.VirtualMachineInstanceClient
 	vmiCache        ctlv1.VirtualMachineInstanceCache
+	nodeClient      ctlcorev1.NodeClient
 	nodeCache       ctlcorev1.NodeCache
 	configMapClient ctlcorev1.ConfigMapClient
 	restClient      kubernetes.Interface
 	kubevirtClient  kubecli.KubevirtClient
 
 	nodeToVMName *sync.Map
+	// resolvedVMIs maps the key of a VMI to the resolvedVMI of the last request to its guest agent
+	resolvedVMIs sync.Map
 
 	namespace string
 }
 
-func (h *Handler) OnVmiChanged(_ string, vmi *kubevirtv1.VirtualMachineInstance) (*kubevirtv1.VirtualMachineInstance, error) {
-	// TODO: Add some unit tests for this controller
+// resolvedVMI is the hostname reported by the guest agent of a VMI, which is valid as long as the VMI isn't recreated
+// and its guest agent doesn't reconnect, e.g. after a reboot of the guest. The hostname is empty if the guest agent
+// failed or timed out, so that a missing guest agent isn't requested again on every change of the VMI.
+type resolvedVMI struct {
+	uid            types.UID
+	agentConnected *metav1.Time
+	hostname       string
+}
 
-	if vmi == nil || vmi.DeletionTimestamp != nil {
+func (h *Handler) OnVmiChanged(key string, vmi *kubevirtv1.VirtualMachineInstance) (*kubevirtv1.VirtualMachineInstance, error) {
+	if vmi == nil {
+		h.forgetVMI(key)
+		return vmi, nil
+	}
+	if vmi.DeletionTimestamp != nil {
 		return vmi, nil
 	}
 
+	migrated := vmi.Annotations != nil && vmi.Labels != nil && vmi.Namespace == h.namespace && utils.IsMigrationCompleted(vmi)
+
+	// keep the node-to-VM mapping up-to-date on every change, e.g. the hostname is reported after the VMI restarts.
+	// The guest agent is requested at most once per change, and not at all if the VMI is resolved already.
+	nodeName := vmi.Name
+	if vmi.Namespace == h.namespace && (migrated || h.isGuestClusterVMI(vmi) && isAgentConnected(vmi)) {
+		nodeName = h.nodeNameOf(h.ctx, vmi)
+	}
+
 	// only handle the migration completed vmi
-	if vmi.Annotations == nil || vmi.Labels == nil || vmi.Namespace != h.namespace || !utils.IsMigrationCompleted(vmi) {
+	if !migrated {
 		logrus.WithFields(logrus.Fields{
 			"namespace": vmi.Namespace,
 			"name":      vmi.Name,
@@ -96,23 +136,6 @@ func (h *Handler) OnVmiChanged(_ string, vmi *kubevirtv1.VirtualMachineInstance)
 		return vmi, nil
 	}
 
-	nodeName := vmi.Name
-	guestAgentInfo, err := h.kubevirtClient.VirtualMachineInstance(vmi.Namespace).GuestOsInfo(context.TODO(), vmi.Name)
-	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"name":      vmi.Name,
-			"namespace": vmi.Namespace,
-		}).WithError(err).Error("failed to get guest agent info, fallback to use vmi name as node name")
-	} else {
-		logrus.WithFields(logrus.Fields{
-			"name":      vmi.Name,
-			"namespace": vmi.Namespace,
-			"hostname":  guestAgentInfo.Hostname,
-		}).Info("get agent info success, using hostname as node name")
-		nodeName = guestAgentInfo.Hostname
-		h.nodeToVMName.Store(nodeName, vmi.Name)
-	}
-
 	node, err := h.nodeCache.Get(nodeName)
 	if err != nil {
 		if !errors.IsNotFound(err) {
@@ -122,6 +145,13 @@ func (h *Handler) OnVmiChanged(_ string, vmi *kubevirtv1.VirtualMachineInstance)
 		return vmi, nil
 	}
 
+	// persist the mapping, so that the node named after the hostname is resolved to its VM after a restart
+	if node.Annotations[utils.AnnotationKeyVMNameOnNode] != vmi.Name {
+		if err := utils.RecordVMNameOnNode(h.nodeClient, nodeName, vmi.Name); err != nil {
+			return vmi, fmt.Errorf("failed to record VM %s/%s on node %s: %w", vmi.Namespace, vmi.Name, nodeName, err)
+		}
+	}
+
 	if !compareTopology(vmi.GetAnnotations(), node.GetLabels()) {
 		if err := h.reSync(vmi); err != nil {
 			return vmi, err
@@ -135,6 +165,142 @@ func (h *Handler) OnVmiChanged(_ string, vmi *kubevirtv1.VirtualMachineInstance)
 	return vmi, nil
 }
 
+// resyncNodeToVMName rebuilds the node-to-VM mapping from the hostnames reported by the guest agents of the VMIs of the
+// guest cluster. The guest agents are requested concurrently with a timeout each, the VMIs whose hostnames can't be
+// got are resolved by their names as before.
+func (h *Handler) resyncNodeToVMName(ctx context.Context) {
+	clusterName := cfg.GetConfig().ClusterName
+	if clusterName == "" || clusterName == utils.DefaultGuestClusterName {
+		// the VMIs of the other guest clusters are labelled with the same default name
+		logrus.Warnf("skip rebuilding the node-to-VM mapping: guest cluster name configuration is empty/default, we cannot identify the cluster")
+		return
+	}
+
+	vmis, err := h.vmis.List(h.namespace, metav1.ListOptions{
+		LabelSelector: labels.Set{utils.LabelKeyGuestClusterNameOnVM: clusterName}.String(),
+	})
+	if err != nil {
+		logrus.WithError(err).Warn("failed to list virtual machine instances, skip rebuilding the node-to-VM mapping")
+		return
+	}
+
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, resyncWorkers)
+	for i := range vmis.Items {
+		vmi := &vmis.Items[i]
+		if vmi.DeletionTimestamp != nil || !isAgentConnected(vmi) {
+			continue
+		}
+		select {
+		case workers <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		}
+		wg.Go(func() {
+			defer func() { <-workers }()
+			h.lookupNodeName(ctx, vmi)
+		})
+	}
+	wg.Wait()
+
+	logrus.WithFields(logrus.Fields{
+		"cluster":   clusterName,
+		"namespace": h.namespace,
+	}).Infof("rebuilt the node-to-VM mapping from %d virtual machine instances", len(vmis.Items))
+}
+
+// nodeNameOf returns the hostname of the VMI resolved before if the VMI isn't recreated and its guest agent hasn't
+// reconnected since, and requests the guest agent otherwise. The VMI name is returned if the guest agent failed before.
+func (h *Handler) nodeNameOf(ctx context.Context, vmi *kubevirtv1.VirtualMachineInstance) string {
+	if v, ok := h.resolvedVMIs.Load(vmi.Namespace + "/" + vmi.Name); ok {
+		resolved := v.(resolvedVMI)
+		if resolved.uid == vmi.UID && resolved.agentConnected.Equal(agentConnectedTime(vmi)) {
+			if resolved.hostname == "" {
+				return vmi.Name
+			}
+			if vmName, ok := h.nodeToVMName.Load(resolved.hostname); ok && vmName == vmi.Name {
+				return resolved.hostname
+			}
+		}
+	}
+	nodeName, _ := h.lookupNodeName(ctx, vmi)
+	return nodeName
+}
+
+// lookupNodeName returns the hostname reported by the guest agent as the node name of the VMI and records the mapping,
+// it falls back to the VMI name if the guest agent can't be reached in time. Both results are kept in resolvedVMIs.
+func (h *Handler) lookupNodeName(ctx context.Context, vmi *kubevirtv1.VirtualMachineInstance) (string, bool) {
+	requestCtx, cancel := context.WithTimeout(ctx, guestOsInfoTimeout)
+	defer cancel()
+
+	resolved := resolvedVMI{uid: vmi.UID, agentConnected: agentConnectedTime(vmi)}
+	guestAgentInfo, err := h.kubevirtClient.VirtualMachineInstance(vmi.Namespace).GuestOsInfo(requestCtx, vmi.Name)
+	if err != nil || guestAgentInfo.Hostname == "" {
+		logrus.WithFields(logrus.Fields{
+			"name":      vmi.Name,
+			"namespace": vmi.Namespace,
+		}).WithError(err).Warn("failed to get hostname from guest agent info, fallback to use vmi name as node name")
+		// the request isn't failed by the guest agent if the cloud provider is stopping
+		if ctx.Err() == nil {
+			h.resolvedVMIs.Store(vmi.Namespace+"/"+vmi.Name, resolved)
+		}
+		return vmi.Name, false
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"name":      vmi.Name,
+		"namespace": vmi.Namespace,
+		"hostname":  guestAgentInfo.Hostname,
+	}).Debug("get agent info success, using hostname as node name")
+	h.nodeToVMName.Store(guestAgentInfo.Hostname, vmi.Name)
+	resolved.hostname = guestAgentInfo.Hostname
+	h.resolvedVMIs.Store(vmi.Namespace+"/"+vmi.Name, resolved)
+
+	return guestAgentInfo.Hostname, true
+}
+
+// forgetVMI removes the nodes mapped to the deleted VMI, the VMI recreated on restart maps them again.
+func (h *Handler) forgetVMI(key string) {
+	namespace, name, ok := strings.Cut(key, "/")
+	if !ok || namespace != h.namespace {
+		return
+	}
+	h.resolvedVMIs.Delete(key)
+	h.nodeToVMName.Range(func(nodeName, vmName any) bool {
+		if vmName == name {
+			h.nodeToVMName.Delete(nodeName)
+		}
+		return true
+	})
+}
+
+func (h *Handler) isGuestClusterVMI(vmi *kubevirtv1.VirtualMachineInstance) bool {
+	clusterName := cfg.GetConfig().ClusterName
+	return clusterName != "" && clusterName != utils.DefaultGuestClusterName &&
+		vmi.Labels[utils.LabelKeyGuestClusterNameOnVM] == clusterName
+}
+
+func isAgentConnected(vmi *kubevirtv1.VirtualMachineInstance) bool {
+	for _, condition := range vmi.Status.Conditions {
+		if condition.Type == kubevirtv1.VirtualMachineInstanceAgentConnected {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// agentConnectedTime returns the last transition time of the AgentConnected condition, which changes when the guest
+// agent reconnects.
+func agentConnectedTime(vmi *kubevirtv1.VirtualMachineInstance) *metav1.Time {
+	for _, condition := range vmi.Status.Conditions {
+		if condition.Type == kubevirtv1.VirtualMachineInstanceAgentConnected {
+			return &condition.LastTransitionTime
+		}
+	}
+	return nil
+}
+
 func (h *Handler) reSync(vmi *kubevirtv1.VirtualMachineInstance) error {
 	return cloudnodeutil.AddOrUpdateTaintOnNode(h.restClient, vmi.Name, &corev1.Taint{
 		Key:    cloudproviderapi.TaintExternalCloudProvider,
@@ -0,0 +1,244 @@
+package virtualmachineinstance
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/harvester/harvester/pkg/builder"
+	harvesterutil "github.com/harvester/harvester/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+
+	cfg "github.com/harvester/harvester-cloud-provider/pkg/config"
+	utils "github.com/harvester/harvester-cloud-provider/pkg/utils"
+	"github.com/harvester/harvester-cloud-provider/pkg/utils/fakeclients"
+)
+
+const (
+	testNamespace   = "default"
+	testClusterName = "guest-0"
+)
+
+func setClusterName(t *testing.T, clusterName string) {
+	old := cfg.GetConfig().ClusterName
+	cfg.GetConfig().ClusterName = clusterName
+	t.Cleanup(func() { cfg.GetConfig().ClusterName = old })
+}
+
+func newVMI(name string, uid types.UID, agentConnected time.Time) *kubevirtv1.VirtualMachineInstance {
+	return &kubevirtv1.VirtualMachineInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   testNamespace,
+			Name:        name,
+			UID:         uid,
+			Labels:      map[string]string{utils.LabelKeyGuestClusterNameOnVM: testClusterName},
+			Annotations: map[string]string{},
+		},
+		Status: kubevirtv1.VirtualMachineInstanceStatus{
+			Conditions: []kubevirtv1.VirtualMachineInstanceCondition{{
+				Type:               kubevirtv1.VirtualMachineInstanceAgentConnected,
+				Status:             corev1.ConditionTrue,
+				LastTransitionTime: metav1.NewTime(agentConnected),
+			}},
+		},
+	}
+}
+
+// hostnames serves the guest agent info with the hostname <vmi-name>-host and counts the requests.
+type hostnames struct {
+	calls atomic.Int32
+	err   error
+}
+
+func (h *hostnames) guestOsInfo(_ context.Context, _, name string) (kubevirtv1.VirtualMachineInstanceGuestAgentInfo, error) {
+	h.calls.Add(1)
+	if h.err != nil {
+		return kubevirtv1.VirtualMachineInstanceGuestAgentInfo{}, h.err
+	}
+	return kubevirtv1.VirtualMachineInstanceGuestAgentInfo{Hostname: name + "-host"}, nil
+}
+
+func newHandler(guestOsInfo fakeclients.GuestOsInfoFunc, vmis ...*kubevirtv1.VirtualMachineInstance) *Handler {
+	return &Handler{
+		ctx:            context.Background(),
+		vmis:           fakeclients.NewVirtualMachineInstanceClient(vmis...),
+		nodeCache:      fakeclients.NewNodeClient().Cache(),
+		kubevirtClient: fakeclients.NewKubevirtClient(guestOsInfo),
+		nodeToVMName:   &sync.Map{},
+		namespace:      testNamespace,
+	}
+}
+
+func Test_OnVmiChanged(t *testing.T) {
+	setClusterName(t, testClusterName)
+	connected := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	vmi := newVMI("vm-0", "uid-0", connected)
+	key := vmi.Namespace + "/" + vmi.Name
+	agent := &hostnames{}
+	h := newHandler(agent.guestOsInfo)
+
+	mustChange := func(vmi *kubevirtv1.VirtualMachineInstance, wantCalls int32) {
+		t.Helper()
+		if _, err := h.OnVmiChanged(key, vmi); err != nil {
+			t.Fatalf("OnVmiChanged() error = %v", err)
+		}
+		if got := agent.calls.Load(); got != wantCalls {
+			t.Errorf("GuestOsInfo() called %d times, want %d", got, wantCalls)
+		}
+		if vmName, ok := h.nodeToVMName.Load("vm-0-host"); !ok || vmName != "vm-0" {
+			t.Errorf("node vm-0-host is mapped to %v, want vm-0", vmName)
+		}
+	}
+
+	mustChange(vmi, 1)
+	// the hostname of an unchanged VMI is known already
+	mustChange(vmi.DeepCopy(), 1)
+
+	reconnected := vmi.DeepCopy()
+	reconnected.Status.Conditions[0].LastTransitionTime = metav1.NewTime(connected.Add(time.Minute))
+	mustChange(reconnected, 2)
+	mustChange(reconnected, 2)
+
+	recreated := newVMI("vm-0", "uid-1", connected.Add(time.Minute))
+	mustChange(recreated, 3)
+
+	// the mapping and the resolved hostname are dropped on deletion
+	if _, err := h.OnVmiChanged(key, nil); err != nil {
+		t.Fatalf("OnVmiChanged() of a deleted VMI error = %v", err)
+	}
+	if vmName, ok := h.nodeToVMName.Load("vm-0-host"); ok {
+		t.Errorf("node vm-0-host is still mapped to %v after the VMI is deleted", vmName)
+	}
+	mustChange(recreated, 4)
+
+	// the VMIs of another namespace are left as they are
+	if _, err := h.OnVmiChanged("other/vm-0", nil); err != nil {
+		t.Fatalf("OnVmiChanged() of a deleted VMI error = %v", err)
+	}
+	if _, ok := h.nodeToVMName.Load("vm-0-host"); !ok {
+		t.Errorf("node vm-0-host is not mapped after a VMI of another namespace is deleted")
+	}
+}
+
+func Test_OnVmiChanged_failedGuestAgent(t *testing.T) {
+	setClusterName(t, testClusterName)
+	connected := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	vmi := newVMI("vm-0", "uid-0", connected)
+	vmi.Labels[builder.LabelKeyVirtualMachineCreator] = harvesterutil.VirtualMachineCreatorNodeDriver
+	agent := &hostnames{err: fmt.Errorf("guest agent is not responding")}
+	h := newHandler(agent.guestOsInfo)
+
+	mustChange := func(vmi *kubevirtv1.VirtualMachineInstance, wantCalls int32) {
+		t.Helper()
+		if _, err := h.OnVmiChanged(vmi.Namespace+"/"+vmi.Name, vmi); err != nil {
+			t.Fatalf("OnVmiChanged() error = %v", err)
+		}
+		if got := agent.calls.Load(); got != wantCalls {
+			t.Errorf("GuestOsInfo() called %d times, want %d", got, wantCalls)
+		}
+	}
+
+	// the failed guest agent is requested once per event of a migrated VMI, and not again until it reconnects
+	mustChange(vmi, 1)
+	mustChange(vmi.DeepCopy(), 1)
+
+	reconnected := vmi.DeepCopy()
+	reconnected.Status.Conditions[0].LastTransitionTime = metav1.NewTime(connected.Add(time.Minute))
+	agent.err = nil
+	mustChange(reconnected, 2)
+	if vmName, ok := h.nodeToVMName.Load("vm-0-host"); !ok || vmName != "vm-0" {
+		t.Errorf("node vm-0-host is mapped to %v after the guest agent reconnected, want vm-0", vmName)
+	}
+}
+
+func Test_lookupNodeName(t *testing.T) {
+	old := guestOsInfoTimeout
+	guestOsInfoTimeout = 10 * time.Millisecond
+	t.Cleanup(func() { guestOsInfoTimeout = old })
+
+	vmi := newVMI("vm-0", "uid-0", time.Now())
+	h := newHandler(func(ctx context.Context, _, _ string) (kubevirtv1.VirtualMachineInstanceGuestAgentInfo, error) {
+		<-ctx.Done()
+		return kubevirtv1.VirtualMachineInstanceGuestAgentInfo{}, ctx.Err()
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if nodeName, resolved := h.lookupNodeName(context.Background(), vmi); resolved || nodeName != vmi.Name {
+			t.Errorf("lookupNodeName() = %s, %v, want %s, false", nodeName, resolved, vmi.Name)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("lookupNodeName() doesn't time out")
+	}
+
+	h.nodeToVMName.Range(func(nodeName, vmName any) bool {
+		t.Errorf("node %v is mapped to %v after the guest agent timed out", nodeName, vmName)
+		return true
+	})
+
+	// the timeout is kept, the guest agent isn't requested again until it reconnects
+	h.kubevirtClient = fakeclients.NewKubevirtClient(func(context.Context, string, string) (kubevirtv1.VirtualMachineInstanceGuestAgentInfo, error) {
+		t.Errorf("guest agent timed out before is requested again")
+		return kubevirtv1.VirtualMachineInstanceGuestAgentInfo{}, nil
+	})
+	if nodeName := h.nodeNameOf(context.Background(), vmi); nodeName != vmi.Name {
+		t.Errorf("nodeNameOf() after the timeout = %s, want %s", nodeName, vmi.Name)
+	}
+}
+
+func Test_resyncNodeToVMName(t *testing.T) {
+	setClusterName(t, testClusterName)
+
+	var vmis []*kubevirtv1.VirtualMachineInstance
+	for i := range 3 * resyncWorkers {
+		vmis = append(vmis, newVMI(fmt.Sprintf("vm-%d", i), types.UID(fmt.Sprintf("uid-%d", i)), time.Now()))
+	}
+	disconnected := newVMI("vm-disconnected", "uid-disconnected", time.Now())
+	disconnected.Status.Conditions[0].Status = corev1.ConditionFalse
+	otherCluster := newVMI("vm-other", "uid-other", time.Now())
+	otherCluster.Labels[utils.LabelKeyGuestClusterNameOnVM] = "guest-1"
+	vmis = append(vmis, disconnected, otherCluster)
+
+	var calls, inFlight, maxInFlight atomic.Int32
+	h := newHandler(func(_ context.Context, _, name string) (kubevirtv1.VirtualMachineInstanceGuestAgentInfo, error) {
+		calls.Add(1)
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			if m := maxInFlight.Load(); n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		return kubevirtv1.VirtualMachineInstanceGuestAgentInfo{Hostname: name + "-host"}, nil
+	}, vmis...)
+
+	h.resyncNodeToVMName(context.Background())
+
+	if got, want := calls.Load(), int32(3*resyncWorkers); got != want {
+		t.Errorf("GuestOsInfo() called %d times, want %d", got, want)
+	}
+	if got := maxInFlight.Load(); got > resyncWorkers {
+		t.Errorf("%d concurrent requests to the guest agents, want at most %d", got, resyncWorkers)
+	}
+	for i := range 3 * resyncWorkers {
+		if vmName, ok := h.nodeToVMName.Load(fmt.Sprintf("vm-%d-host", i)); !ok || vmName != fmt.Sprintf("vm-%d", i) {
+			t.Errorf("node vm-%d-host is mapped to %v, want vm-%d", i, vmName, i)
+		}
+	}
+	for _, nodeName := range []string{"vm-disconnected-host", "vm-other-host"} {
+		if vmName, ok := h.nodeToVMName.Load(nodeName); ok {
+			t.Errorf("node %s is mapped to %v, want unmapped", nodeName, vmName)
+		}
+	}
+}
@@ -4,10 +4,13 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"text/template"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
+	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/util/validation"
 
 	"github.com/harvester/harvester-cloud-provider/pkg/config"
@@ -21,7 +24,7 @@ func GetCurrentConfigString(cfg *config.Config) string {
 		return ""
 	}
 
-	return fmt.Sprintf("--%s=%v --%s=%v --%s=%v --%s=%v --%s=%v --%s=%v --%s=%v --%s=%v",
+	return fmt.Sprintf("--%s=%v --%s=%v --%s=%v --%s=%v --%s=%v --%s=%v --%s=%v --%s=%v --%s=%v --%s=%v --%s=%v --%s=%v --%s=%v --%s=%v --%s=%v",
 		FlagClusterName, cfg.ClusterName,
 		FlagCloudProviderControllers, cfg.CloudProviderControllers,
 		FlagManagementNetwork, cfg.ManagementNetwork,
@@ -30,7 +33,14 @@ func GetCurrentConfigString(cfg *config.Config) string {
 		FlagNodeExcludeIPRanges, cfg.GetNodeExcludeIPRangesCmdString(),
 		FlagDisableAnnotationAlphaProvidedIPAddr, cfg.DisableAnnotationAlphaProvidedIPAddr,
 		FlagDisableVmiController, cfg.DisableVMIController,
-		FlagShowFullHelpOnError, cfg.ShowFullHelpOnError)
+		FlagShowFullHelpOnError, cfg.ShowFullHelpOnError,
+		FlagLoadBalancerGCInterval, cfg.LoadBalancerGCInterval,
+		FlagLoadBalancerGCGracePeriod, cfg.LoadBalancerGCGracePeriod,
+		FlagLoadBalancerGCDryRun, cfg.LoadBalancerGCDryRun,
+		FlagLoadBalancerDirectStatus, cfg.LoadBalancerDirectStatus,
+		FlagLoadBalancerIPMode, cfg.LoadBalancerIPMode,
+		FlagLoadBalancerHostnameTemplate, cfg.LoadBalancerHostnameTemplate,
+		FlagVIPAnnouncer, cfg.VIPAnnouncer)
 }
 
 // syncAndValidateHarvesterConfig bridges the gap between the K8s framework and Harvester needs.
@@ -104,6 +114,13 @@ func SyncAndValidateHarvesterConfig(cmd *cobra.Command, cfg *config.Config) erro
 		}
 		return val, nil
 	}
+	getDuration := func(name string) (time.Duration, error) {
+		val, err := flags.GetDuration(name)
+		if err != nil {
+			return 0, fmt.Errorf("internal error: flag %q not registered as duration: %w", name, err)
+		}
+		return val, nil
+	}
 	getStrSlice := func(name string) ([]string, error) {
 		val, err := flags.GetStringSlice(name)
 		if err != nil {
@@ -142,6 +159,28 @@ func SyncAndValidateHarvesterConfig(cmd *cobra.Command, cfg *config.Config) erro
 		return err
 	}
 
+	if cfg.LoadBalancerGCInterval, err = getDuration(FlagLoadBalancerGCInterval); err != nil {
+		return err
+	}
+	if cfg.LoadBalancerGCGracePeriod, err = getDuration(FlagLoadBalancerGCGracePeriod); err != nil {
+		return err
+	}
+	if cfg.LoadBalancerGCDryRun, err = getBool(FlagLoadBalancerGCDryRun); err != nil {
+		return err
+	}
+	if cfg.LoadBalancerDirectStatus, err = getBool(FlagLoadBalancerDirectStatus); err != nil {
+		return err
+	}
+	if cfg.LoadBalancerIPMode, err = getStr(FlagLoadBalancerIPMode); err != nil {
+		return err
+	}
+	if cfg.LoadBalancerHostnameTemplate, err = getStr(FlagLoadBalancerHostnameTemplate); err != nil {
+		return err
+	}
+	if cfg.VIPAnnouncer, err = getStr(FlagVIPAnnouncer); err != nil {
+		return err
+	}
+
 	controllerSlice, err := getStrSlice(FlagCloudProviderControllers)
 	if err != nil {
 		return err
@@ -172,6 +211,41 @@ func SyncAndValidateHarvesterConfig(cmd *cobra.Command, cfg *config.Config) erro
 		return err
 	}
 
+	// 7. Strict Validation: LoadBalancer garbage collection
+	if cfg.LoadBalancerGCInterval < 0 {
+		return fmt.Errorf("invalid configuration for --%s: %v, it must not be negative", FlagLoadBalancerGCInterval, cfg.LoadBalancerGCInterval)
+	}
+	if cfg.LoadBalancerGCGracePeriod < 0 {
+		return fmt.Errorf("invalid configuration for --%s: %v, it must not be negative", FlagLoadBalancerGCGracePeriod, cfg.LoadBalancerGCGracePeriod)
+	}
+
+	// 8. Strict Validation: LoadBalancer status
+	// The ipMode and the hostname are only written when the status is returned directly.
+	switch v1.LoadBalancerIPMode(cfg.LoadBalancerIPMode) {
+	case "", v1.LoadBalancerIPModeVIP, v1.LoadBalancerIPModeProxy:
+	default:
+		return fmt.Errorf("invalid configuration for --%s: %q, it must be %s or %s", FlagLoadBalancerIPMode,
+			cfg.LoadBalancerIPMode, v1.LoadBalancerIPModeVIP, v1.LoadBalancerIPModeProxy)
+	}
+	if _, err := ParseLoadBalancerHostnameTemplate(cfg.LoadBalancerHostnameTemplate); err != nil {
+		return fmt.Errorf("invalid configuration for --%s: %w", FlagLoadBalancerHostnameTemplate, err)
+	}
+	// 9. Strict Validation: VIP announcer
+	// Without an announcer, nobody else writes the load balancer status.
+	switch cfg.VIPAnnouncer {
+	case VIPAnnouncerKubeVip, VIPAnnouncerMetalLB, VIPAnnouncerCilium:
+	case VIPAnnouncerNone:
+		cfg.LoadBalancerDirectStatus = true
+	default:
+		return fmt.Errorf("invalid configuration for --%s: %q, it must be one of %s, %s, %s or %s", FlagVIPAnnouncer,
+			cfg.VIPAnnouncer, VIPAnnouncerKubeVip, VIPAnnouncerMetalLB, VIPAnnouncerCilium, VIPAnnouncerNone)
+	}
+
+	if !cfg.LoadBalancerDirectStatus && (cfg.LoadBalancerIPMode != "" || cfg.LoadBalancerHostnameTemplate != "") {
+		logrus.Warnf("The '--%s' and '--%s' take no effect without '--%s'.", FlagLoadBalancerIPMode,
+			FlagLoadBalancerHostnameTemplate, FlagLoadBalancerDirectStatus)
+	}
+
 	logrus.Infof("%s effective configurations: %s", HarvesterCloudProvider, GetCurrentConfigString(cfg))
 	if cfg.ManagementNetwork == "" {
 		logrus.Warnf("The '--%s' is not specified. Falling back to default discovery:", FlagManagementNetwork)
@@ -292,3 +366,33 @@ func normalizeAndWarnClusterName(logger logrus.FieldLogger, rawName string) stri
 
 	return normalized
 }
+
+// LoadBalancerHostname is the data of the template --lb-hostname-template.
+type LoadBalancerHostname struct {
+	Name        string
+	Namespace   string
+	ClusterName string
+}
+
+// ParseLoadBalancerHostnameTemplate parses the hostname template of the load balancer ingresses, it returns nil if the
+// template is empty. The template is executed with a sample service to fail early on unknown fields and on templates
+// which can't produce a DNS subdomain.
+func ParseLoadBalancerHostnameTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+
+	tmpl, err := template.New(FlagLoadBalancerHostnameTemplate).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, LoadBalancerHostname{Name: "svc", Namespace: "default", ClusterName: DefaultGuestClusterName}); err != nil {
+		return nil, err
+	}
+	if errs := validation.IsDNS1123Subdomain(b.String()); len(errs) > 0 {
+		return nil, fmt.Errorf("hostname %q is invalid, %s", b.String(), strings.Join(errs, "; "))
+	}
+
+	return tmpl, nil
+}
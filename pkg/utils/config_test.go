@@ -22,6 +22,13 @@ func getCommandAndFlag() (*cobra.Command, *flag.FlagSet) {
 	f.StringSlice(FlagCloudProviderControllers, []string{}, "")
 	f.StringSlice(FlagNodeExcludeIPRanges, []string{}, "")
 	f.Bool(FlagDisableAnnotationAlphaProvidedIPAddr, false, "")
+	f.Duration(FlagLoadBalancerGCInterval, DefaultLoadBalancerGCInterval, "")
+	f.Duration(FlagLoadBalancerGCGracePeriod, DefaultLoadBalancerGCGracePeriod, "")
+	f.Bool(FlagLoadBalancerGCDryRun, false, "")
+	f.Bool(FlagLoadBalancerDirectStatus, false, "")
+	f.String(FlagLoadBalancerIPMode, "", "")
+	f.String(FlagLoadBalancerHostnameTemplate, "", "")
+	f.String(FlagVIPAnnouncer, VIPAnnouncerKubeVip, "")
 
 	return cmd, f
 }
@@ -44,6 +51,15 @@ func Test_SyncAndValidateHarvesterConfig(t *testing.T) {
 		if expected.config.NodeIPCIDR != actual.NodeIPCIDR {
 			return fmt.Errorf(mismatch, "NodeIPCIDR", expected.config.NodeIPCIDR, actual.NodeIPCIDR)
 		}
+		if expected.config.LoadBalancerIPMode != actual.LoadBalancerIPMode {
+			return fmt.Errorf(mismatch, "LoadBalancerIPMode", expected.config.LoadBalancerIPMode, actual.LoadBalancerIPMode)
+		}
+		if expected.config.LoadBalancerHostnameTemplate != actual.LoadBalancerHostnameTemplate {
+			return fmt.Errorf(mismatch, "LoadBalancerHostnameTemplate", expected.config.LoadBalancerHostnameTemplate, actual.LoadBalancerHostnameTemplate)
+		}
+		if expected.config.LoadBalancerDirectStatus != actual.LoadBalancerDirectStatus {
+			return fmt.Errorf(mismatch, "LoadBalancerDirectStatus", expected.config.LoadBalancerDirectStatus, actual.LoadBalancerDirectStatus)
+		}
 		if expected.lenExcludeIPRangesPrefixes != len(actual.GetNodeExcludeIPPrefixes()) {
 			return fmt.Errorf(mismatch, "lenExcludeIPRangesPrefixes", expected.lenExcludeIPRangesPrefixes, len(actual.GetNodeExcludeIPPrefixes()))
 		}
@@ -230,6 +246,73 @@ func Test_SyncAndValidateHarvesterConfig(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "Error: Negative LoadBalancer GC interval",
+			inputFlags: map[string]interface{}{
+				FlagClusterName:            "test",
+				FlagLoadBalancerGCInterval: "-1m",
+			},
+			wantErr: true,
+		},
+		{
+			name: "LoadBalancer direct status",
+			inputFlags: map[string]interface{}{
+				FlagClusterName:                  "test",
+				FlagLoadBalancerDirectStatus:     "true",
+				FlagLoadBalancerIPMode:           "Proxy",
+				FlagLoadBalancerHostnameTemplate: "{{.Name}}.{{.Namespace}}.{{.ClusterName}}.example.com",
+			},
+			expected: expectedResult{
+				config: config.Config{
+					ClusterName:                  "test",
+					LoadBalancerDirectStatus:     true,
+					LoadBalancerIPMode:           "Proxy",
+					LoadBalancerHostnameTemplate: "{{.Name}}.{{.Namespace}}.{{.ClusterName}}.example.com",
+				},
+			},
+		},
+		{
+			name: "No VIP announcer returns the status directly",
+			inputFlags: map[string]interface{}{
+				FlagClusterName:  "test",
+				FlagVIPAnnouncer: VIPAnnouncerNone,
+			},
+			expected: expectedResult{
+				config: config.Config{ClusterName: "test", LoadBalancerDirectStatus: true},
+			},
+		},
+		{
+			name: "Error: Unknown VIP announcer",
+			inputFlags: map[string]interface{}{
+				FlagClusterName:  "test",
+				FlagVIPAnnouncer: "keepalived",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Error: Invalid LoadBalancer ipMode",
+			inputFlags: map[string]interface{}{
+				FlagClusterName:        "test",
+				FlagLoadBalancerIPMode: "DSR",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Error: LoadBalancer hostname template with unknown field",
+			inputFlags: map[string]interface{}{
+				FlagClusterName:                  "test",
+				FlagLoadBalancerHostnameTemplate: "{{.Name}}.{{.Zone}}.example.com",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Error: LoadBalancer hostname template producing an invalid hostname",
+			inputFlags: map[string]interface{}{
+				FlagClusterName:                  "test",
+				FlagLoadBalancerHostnameTemplate: "{{.Name}}_{{.Namespace}}",
+			},
+			wantErr: true,
+		},
 		{
 			name: "Error: Invalid CIDR, IPv4 local host",
 			inputFlags: map[string]interface{}{
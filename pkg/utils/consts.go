@@ -1,5 +1,7 @@
 package utils
 
+import "time"
+
 const (
 	HarvesterCloudProvider = "cloudprovider.harvesterhci.io"
 
@@ -12,17 +14,90 @@ const (
 	KeyNamespace      = HarvesterCloudProviderPrefix + "namespace"
 	KeyPrimaryService = HarvesterCloudProviderPrefix + "primary-service"
 
+	// KeyPromoteOnPrimaryDelete opts in to the promotion of a secondary service when it is set to "true" on the primary
+	// service. When the primary service is deleted, the secondary service with it set to "true" is preferred to take
+	// over the load balancer, otherwise the oldest secondary service is promoted.
+	KeyPromoteOnPrimaryDelete = HarvesterCloudProviderPrefix + "promote-on-primary-delete"
+
+	// KeyLoadBalancerName is set on the promoted service, its value is the names of the load balancers taken over from
+	// the deleted primary service separated by comma, in the order of the IP families. It's also set on the services
+	// with KeyStableLoadBalancerName.
+	KeyLoadBalancerName = HarvesterCloudProviderPrefix + "lb-name"
+
+	// KeyStableLoadBalancerName opts in to the load balancer names without the UID of the service when it is set to
+	// "true". The names are written into KeyLoadBalancerName on the first creation, and a recreated service carrying
+	// the same names adopts the load balancers and their addresses.
+	KeyStableLoadBalancerName = HarvesterCloudProviderPrefix + "stable-lb-name"
+
+	// KeyAllowNetworkMigration allows changing the network annotation of a primary service whose load balancer exists when
+	// it is set to "true". A new load balancer is created on the new network, and the old one is deleted after the
+	// address of the new one is switched to.
+	KeyAllowNetworkMigration = HarvesterCloudProviderPrefix + "allow-network-migration"
+
+	// KeyPortReservations is maintained on the primary service, its value is a JSON object mapping the ports
+	// "<protocol>/<port>" of the secondary services to their owners "<namespace>/<name>". It is updated with optimistic
+	// concurrency, so that two secondary services can't claim the same port.
+	KeyPortReservations = HarvesterCloudProviderPrefix + "port-reservations"
+
+	// KeyIPPool pins the load balancer of the service to the named Harvester IPPool, it can't be changed after the
+	// load balancer is created.
+	KeyIPPool = HarvesterCloudProviderPrefix + "ip-pool"
+
+	// KeyRequestedIP would request a specific IP like the field spec.loadBalancerIP of the service. Both are rejected,
+	// as the Harvester LoadBalancer can't allocate a specific IP.
+	KeyRequestedIP = HarvesterCloudProviderPrefix + "requested-ip"
+
+	// KeyWorkloadType selects the workload type of the Harvester load balancer, "cluster" by default. With "vm", the
+	// Harvester load balancer forwards the traffic to the VMs of the guest nodes selected by KeyBackendNodeSelector
+	// directly.
+	KeyWorkloadType = HarvesterCloudProviderPrefix + "workload-type"
+	// KeyBackendNodeSelector is a label selector of the guest nodes backing a load balancer of the workload type "vm",
+	// e.g. "node-role.kubernetes.io/ingress=true". All nodes are selected without it.
+	KeyBackendNodeSelector = HarvesterCloudProviderPrefix + "backend-node-selector"
+	// KeyBackendServers is maintained on the primary service, its value is the backend servers of its Harvester load
+	// balancer separated by comma.
+	KeyBackendServers = HarvesterCloudProviderPrefix + "backend-servers"
+
+	// health check of the load balancer, refer doc/load-balancer-request-parameters.md
+	// only the port is required, the others fall back to the defaults below when absent.
+	KeyHealthCheckPort             = HarvesterCloudProviderPrefix + "healthcheck-port"
+	KeyHealthCheckSuccessThreshold = HarvesterCloudProviderPrefix + "healthcheck-success-threshold"
+	KeyHealthCheckFailureThreshold = HarvesterCloudProviderPrefix + "healthcheck-failure-threshold"
+	KeyHealthCheckPeriodSeconds    = HarvesterCloudProviderPrefix + "healthcheck-periodseconds"
+	KeyHealthCheckTimeoutSeconds   = HarvesterCloudProviderPrefix + "healthcheck-timeoutseconds"
+
+	DefaultHealthCheckSuccessThreshold = 1
+	DefaultHealthCheckFailureThreshold = 3
+	DefaultHealthCheckPeriodSeconds    = 5
+	DefaultHealthCheckTimeoutSeconds   = 3
+
 	KeyKubevipLoadBalancerIP = "kube-vip.io/loadbalancerIPs"
 
 	// KeyKubevipServiceInterface is the annotation key for kube-vip service interface.
 	KeyKubevipServiceInterface = "kube-vip.io/serviceInterface"
 
+	// the annotations of the addresses read by the other VIP announcers, refer to FlagVIPAnnouncer
+	KeyMetalLBLoadBalancerIPs = "metallb.universe.tf/loadBalancerIPs"
+	KeyCiliumLoadBalancerIPs  = "io.cilium/lb-ipam-ips"
+	// the annotations allowing the primary service and its secondary services to share the addresses
+	KeyMetalLBAllowSharedIP = "metallb.universe.tf/allow-shared-ip"
+	KeyCiliumSharingKey     = "lbipam.cilium.io/sharing-key"
+	// KeyLoadBalancerIPs records the addresses when no VIP announcer runs in the guest cluster
+	KeyLoadBalancerIPs = HarvesterCloudProviderPrefix + "loadbalancer-ips"
+	// LabelKeyServiceInterface is the label of the interface to announce the addresses on, it's used by the MetalLB
+	// IPAddressPool and the Cilium L2 announcement policy to select the services.
+	LabelKeyServiceInterface = HarvesterCloudProviderPrefix + "service-interface"
+
 	// Note: When a node reports multiple addresses as "InternalIP", Kubernetes typically
 	// prioritizes the first entry. This annotation effectively "hides" specific IPs from being
 	// categorized as "ExternalIP" without actually making them functional secondary
 	// internal addresses in the Kubernetes API.
 	KeyAdditionalInternalIPs = HarvesterCloudProviderPrefix + "additional-internal-ips"
 
+	// AnnotationKeyVMNameOnNode records the name of the VM backing the guest node, so that the guest node named after
+	// the hostname reported by the guest agent is still resolved to its VM after the cloud provider restarts.
+	AnnotationKeyVMNameOnNode = HarvesterCloudProviderPrefix + "vm-name"
+
 	// KeyInterfaceNADMapping is the annotation key used on Node objects (kept for reference).
 	KeyInterfaceNADMapping = HarvesterCloudProviderPrefix + "interface-nad-mapping"
 
@@ -60,6 +135,22 @@ const (
 	// which required sanitizing '/' to '_' because label values cannot contain slashes.
 	AnnotationKeyNetworkOnLB = HarvesterCloudProviderPrefix + "lb-network"
 
+	// FinalizerSecondaryServices is added to the primary service while secondary services share its LoadBalancer, the
+	// primary service stays in Terminating until the secondary services are deleted or moved.
+	FinalizerSecondaryServices = HarvesterCloudProviderPrefix + "secondary-services"
+
+	// AnnotationKeyServiceUIDOnLB records the UID of the guest service owning the LoadBalancer, the garbage collector
+	// deletes the LoadBalancer if the service with the UID is gone.
+	AnnotationKeyServiceUIDOnLB = HarvesterCloudProviderPrefix + "serviceUID"
+
+	// AnnotationKeyBackendVMsOnLB records the VMs of the guest nodes eligible to receive the traffic separated by comma,
+	// the nodes excluded from external load balancers, cordoned or being deleted are left out.
+	AnnotationKeyBackendVMsOnLB = HarvesterCloudProviderPrefix + "backend-vms"
+
+	// AnnotationKeyIPFamilyOnLB records the IP family the LoadBalancer allocates the address for. A dual-stack service
+	// has one LoadBalancer per IP family.
+	AnnotationKeyIPFamilyOnLB = HarvesterCloudProviderPrefix + "ip-family"
+
 	// cloud-provider framework injects `kubernetes` as cluster-name when runtime env `--cluster-name` is not set
 	// if `--cluster-name=abc` then `cluster-name` is `abc`
 	// if `--cluster-name=` then `cluster-name` is `` (empty)
@@ -102,6 +193,31 @@ const (
 
 	FlagNodeExcludeIPRanges = "node-exclude-ip-ranges"
 
+	// garbage collection of the Harvester LoadBalancers whose guest services are deleted, e.g. when the cloud-provider
+	// is down while the service is deleted. An interval of 0 disables it.
+	FlagLoadBalancerGCInterval    = "lb-gc-interval"
+	FlagLoadBalancerGCGracePeriod = "lb-gc-grace-period"
+	FlagLoadBalancerGCDryRun      = "lb-gc-dry-run"
+
+	// the load balancer status of the services is returned by the cloud provider instead of being written by kube-vip,
+	// so that it is correct with other VIP agents or none.
+	FlagLoadBalancerDirectStatus     = "lb-direct-status"
+	FlagLoadBalancerIPMode           = "lb-ip-mode"
+	FlagLoadBalancerHostnameTemplate = "lb-hostname-template"
+
+	// FlagVIPAnnouncer selects the agent announcing the addresses of the load balancers in the guest cluster.
+	FlagVIPAnnouncer = "vip-announcer"
+
+	VIPAnnouncerKubeVip = "kube-vip"
+	VIPAnnouncerMetalLB = "metallb"
+	VIPAnnouncerCilium  = "cilium"
+	// VIPAnnouncerNone returns the load balancer status directly, refer to FlagLoadBalancerDirectStatus
+	VIPAnnouncerNone = "none"
+
+	// DefaultLoadBalancerGCInterval disables the garbage collection, it deletes the remote load balancers and is opt-in
+	DefaultLoadBalancerGCInterval    = 0
+	DefaultLoadBalancerGCGracePeriod = 10 * time.Minute
+
 	// LabelKeyGuestClusterNameOnVM is the label applied to VMs that belong to a guest cluster.
 	// Value is the guest cluster name
 	LabelKeyGuestClusterNameOnVM = "guestcluster.harvesterhci.io/name"
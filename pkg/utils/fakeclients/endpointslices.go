@@ -0,0 +1,47 @@
+package fakeclients
+
+import (
+	"github.com/rancher/wrangler/v3/pkg/generic"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// EndpointSliceCache is a minimal in-memory EndpointSliceCache for use in unit tests.
+type EndpointSliceCache struct {
+	endpointSlices map[string]*discoveryv1.EndpointSlice
+}
+
+// NewEndpointSliceCache returns an EndpointSliceCache storing the given endpoint slices.
+func NewEndpointSliceCache(endpointSlices ...*discoveryv1.EndpointSlice) *EndpointSliceCache {
+	f := &EndpointSliceCache{endpointSlices: make(map[string]*discoveryv1.EndpointSlice)}
+	for _, slice := range endpointSlices {
+		f.endpointSlices[slice.Namespace+"/"+slice.Name] = slice.DeepCopy()
+	}
+	return f
+}
+
+func (f *EndpointSliceCache) Get(namespace, name string) (*discoveryv1.EndpointSlice, error) {
+	slice, ok := f.endpointSlices[namespace+"/"+name]
+	if !ok {
+		return nil, apierrors.NewNotFound(schema.GroupResource{Group: discoveryv1.GroupName, Resource: "endpointslices"}, name)
+	}
+	return slice.DeepCopy(), nil
+}
+
+func (f *EndpointSliceCache) List(namespace string, selector labels.Selector) ([]*discoveryv1.EndpointSlice, error) {
+	var endpointSlices []*discoveryv1.EndpointSlice
+	for _, slice := range f.endpointSlices {
+		if slice.Namespace == namespace && selector.Matches(labels.Set(slice.Labels)) {
+			endpointSlices = append(endpointSlices, slice.DeepCopy())
+		}
+	}
+	return endpointSlices, nil
+}
+
+func (f *EndpointSliceCache) AddIndexer(_ string, _ generic.Indexer[*discoveryv1.EndpointSlice]) {}
+
+func (f *EndpointSliceCache) GetByIndex(_, _ string) ([]*discoveryv1.EndpointSlice, error) {
+	return nil, nil
+}
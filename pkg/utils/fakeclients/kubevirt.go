@@ -0,0 +1,37 @@
+package fakeclients
+
+import (
+	"context"
+
+	kubevirtv1 "kubevirt.io/api/core/v1"
+	"kubevirt.io/client-go/kubecli"
+)
+
+// GuestOsInfoFunc serves a request to the guest agent of the VMI namespace/name.
+type GuestOsInfoFunc func(ctx context.Context, namespace, name string) (kubevirtv1.VirtualMachineInstanceGuestAgentInfo, error)
+
+// KubevirtClient is a minimal KubevirtClient for use in unit tests, only the guest agent info of the VMIs is served.
+// Calling any other method panics.
+type KubevirtClient struct {
+	kubecli.KubevirtClient
+	guestOsInfo GuestOsInfoFunc
+}
+
+// NewKubevirtClient returns a KubevirtClient serving the guest agent info of the VMIs by guestOsInfo.
+func NewKubevirtClient(guestOsInfo GuestOsInfoFunc) *KubevirtClient {
+	return &KubevirtClient{guestOsInfo: guestOsInfo}
+}
+
+func (f *KubevirtClient) VirtualMachineInstance(namespace string) kubecli.VirtualMachineInstanceInterface {
+	return &virtualMachineInstanceInterface{namespace: namespace, guestOsInfo: f.guestOsInfo}
+}
+
+type virtualMachineInstanceInterface struct {
+	kubecli.VirtualMachineInstanceInterface
+	namespace   string
+	guestOsInfo GuestOsInfoFunc
+}
+
+func (f *virtualMachineInstanceInterface) GuestOsInfo(ctx context.Context, name string) (kubevirtv1.VirtualMachineInstanceGuestAgentInfo, error) {
+	return f.guestOsInfo(ctx, f.namespace, name)
+}
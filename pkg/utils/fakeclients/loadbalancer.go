@@ -0,0 +1,96 @@
+package fakeclients
+
+import (
+	"fmt"
+
+	lbv1 "github.com/harvester/harvester-load-balancer/pkg/apis/loadbalancer.harvesterhci.io/v1beta1"
+	"github.com/rancher/wrangler/v3/pkg/generic"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/rest"
+)
+
+var loadBalancerResource = lbv1.SchemeGroupVersion.WithResource("loadbalancers").GroupResource()
+
+// LoadBalancerClient is a minimal in-memory LoadBalancerClient for use in unit tests.
+type LoadBalancerClient struct {
+	lbs map[string]*lbv1.LoadBalancer
+}
+
+// NewLoadBalancerClient returns a LoadBalancerClient storing the given LoadBalancers.
+func NewLoadBalancerClient(lbs ...*lbv1.LoadBalancer) *LoadBalancerClient {
+	f := &LoadBalancerClient{lbs: make(map[string]*lbv1.LoadBalancer)}
+	for _, lb := range lbs {
+		f.lbs[lb.Namespace+"/"+lb.Name] = lb.DeepCopy()
+	}
+	return f
+}
+
+func (f *LoadBalancerClient) Create(lb *lbv1.LoadBalancer) (*lbv1.LoadBalancer, error) {
+	key := lb.Namespace + "/" + lb.Name
+	if _, ok := f.lbs[key]; ok {
+		return nil, apierrors.NewAlreadyExists(loadBalancerResource, lb.Name)
+	}
+	f.lbs[key] = lb.DeepCopy()
+	return lb.DeepCopy(), nil
+}
+
+func (f *LoadBalancerClient) Update(lb *lbv1.LoadBalancer) (*lbv1.LoadBalancer, error) {
+	key := lb.Namespace + "/" + lb.Name
+	if _, ok := f.lbs[key]; !ok {
+		return nil, apierrors.NewNotFound(loadBalancerResource, lb.Name)
+	}
+	f.lbs[key] = lb.DeepCopy()
+	return lb.DeepCopy(), nil
+}
+
+func (f *LoadBalancerClient) UpdateStatus(lb *lbv1.LoadBalancer) (*lbv1.LoadBalancer, error) {
+	return f.Update(lb)
+}
+
+func (f *LoadBalancerClient) Delete(namespace, name string, _ *metav1.DeleteOptions) error {
+	key := namespace + "/" + name
+	if _, ok := f.lbs[key]; !ok {
+		return apierrors.NewNotFound(loadBalancerResource, name)
+	}
+	delete(f.lbs, key)
+	return nil
+}
+
+// Get returns an empty LoadBalancer together with the NotFound error like the generated client does.
+func (f *LoadBalancerClient) Get(namespace, name string, _ metav1.GetOptions) (*lbv1.LoadBalancer, error) {
+	lb, ok := f.lbs[namespace+"/"+name]
+	if !ok {
+		return &lbv1.LoadBalancer{}, apierrors.NewNotFound(loadBalancerResource, name)
+	}
+	return lb.DeepCopy(), nil
+}
+
+func (f *LoadBalancerClient) List(namespace string, opts metav1.ListOptions) (*lbv1.LoadBalancerList, error) {
+	selector, err := labels.Parse(opts.LabelSelector)
+	if err != nil {
+		return nil, err
+	}
+	list := &lbv1.LoadBalancerList{}
+	for _, lb := range f.lbs {
+		if (namespace == metav1.NamespaceAll || lb.Namespace == namespace) && selector.Matches(labels.Set(lb.Labels)) {
+			list.Items = append(list.Items, *lb.DeepCopy())
+		}
+	}
+	return list, nil
+}
+
+func (f *LoadBalancerClient) Watch(_ string, _ metav1.ListOptions) (watch.Interface, error) {
+	return nil, fmt.Errorf("watch is not supported by the fake client")
+}
+
+func (f *LoadBalancerClient) Patch(_, _ string, _ types.PatchType, _ []byte, _ ...string) (*lbv1.LoadBalancer, error) {
+	return nil, fmt.Errorf("patch is not supported by the fake client")
+}
+
+func (f *LoadBalancerClient) WithImpersonation(_ rest.ImpersonationConfig) (generic.ClientInterface[*lbv1.LoadBalancer, *lbv1.LoadBalancerList], error) {
+	return f, nil
+}
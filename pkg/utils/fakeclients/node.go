@@ -0,0 +1,115 @@
+package fakeclients
+
+import (
+	"fmt"
+
+	"github.com/rancher/wrangler/v3/pkg/generic"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/rest"
+)
+
+var nodeResource = schema.GroupResource{Resource: "nodes"}
+
+// NodeClient is a minimal in-memory NodeClient for use in unit tests. Its Cache reads the same nodes.
+type NodeClient struct {
+	nodes map[string]*v1.Node
+}
+
+// NodeCache is the NodeCache view of a NodeClient.
+type NodeCache NodeClient
+
+// NewNodeClient returns a NodeClient storing the given nodes.
+func NewNodeClient(nodes ...*v1.Node) *NodeClient {
+	f := &NodeClient{nodes: make(map[string]*v1.Node)}
+	for _, node := range nodes {
+		f.nodes[node.Name] = node.DeepCopy()
+	}
+	return f
+}
+
+// Cache returns the cache sharing the nodes with the client.
+func (f *NodeClient) Cache() *NodeCache {
+	return (*NodeCache)(f)
+}
+
+func (f *NodeClient) Create(node *v1.Node) (*v1.Node, error) {
+	if _, ok := f.nodes[node.Name]; ok {
+		return nil, apierrors.NewAlreadyExists(nodeResource, node.Name)
+	}
+	f.nodes[node.Name] = node.DeepCopy()
+	return node.DeepCopy(), nil
+}
+
+func (f *NodeClient) Update(node *v1.Node) (*v1.Node, error) {
+	if _, ok := f.nodes[node.Name]; !ok {
+		return nil, apierrors.NewNotFound(nodeResource, node.Name)
+	}
+	f.nodes[node.Name] = node.DeepCopy()
+	return node.DeepCopy(), nil
+}
+
+func (f *NodeClient) UpdateStatus(node *v1.Node) (*v1.Node, error) {
+	return f.Update(node)
+}
+
+func (f *NodeClient) Delete(name string, _ *metav1.DeleteOptions) error {
+	if _, ok := f.nodes[name]; !ok {
+		return apierrors.NewNotFound(nodeResource, name)
+	}
+	delete(f.nodes, name)
+	return nil
+}
+
+func (f *NodeClient) Get(name string, _ metav1.GetOptions) (*v1.Node, error) {
+	node, ok := f.nodes[name]
+	if !ok {
+		return nil, apierrors.NewNotFound(nodeResource, name)
+	}
+	return node.DeepCopy(), nil
+}
+
+func (f *NodeClient) List(_ metav1.ListOptions) (*v1.NodeList, error) {
+	list := &v1.NodeList{}
+	for _, node := range f.nodes {
+		list.Items = append(list.Items, *node.DeepCopy())
+	}
+	return list, nil
+}
+
+func (f *NodeClient) Watch(_ metav1.ListOptions) (watch.Interface, error) {
+	return nil, fmt.Errorf("watch is not supported by the fake client")
+}
+
+func (f *NodeClient) Patch(_ string, _ types.PatchType, _ []byte, _ ...string) (*v1.Node, error) {
+	return nil, fmt.Errorf("patch is not supported by the fake client")
+}
+
+func (f *NodeClient) WithImpersonation(_ rest.ImpersonationConfig) (generic.NonNamespacedClientInterface[*v1.Node, *v1.NodeList], error) {
+	return f, nil
+}
+
+func (f *NodeCache) Get(name string) (*v1.Node, error) {
+	return (*NodeClient)(f).Get(name, metav1.GetOptions{})
+}
+
+func (f *NodeCache) List(selector labels.Selector) ([]*v1.Node, error) {
+	var nodes []*v1.Node
+	for _, node := range f.nodes {
+		if selector.Matches(labels.Set(node.Labels)) {
+			nodes = append(nodes, node.DeepCopy())
+		}
+	}
+	return nodes, nil
+}
+
+func (f *NodeCache) AddIndexer(_ string, _ generic.Indexer[*v1.Node]) {}
+
+func (f *NodeCache) GetByIndex(_, _ string) ([]*v1.Node, error) {
+	return nil, nil
+}
@@ -0,0 +1,129 @@
+package fakeclients
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/rancher/wrangler/v3/pkg/generic"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/rest"
+)
+
+var serviceResource = schema.GroupResource{Resource: "services"}
+
+// ServiceClient is a minimal in-memory ServiceClient for use in unit tests. Its Cache reads the same services.
+type ServiceClient struct {
+	services map[string]*v1.Service
+}
+
+// ServiceCache is the ServiceCache view of a ServiceClient.
+type ServiceCache ServiceClient
+
+// NewServiceClient returns a ServiceClient storing the given services.
+func NewServiceClient(services ...*v1.Service) *ServiceClient {
+	f := &ServiceClient{services: make(map[string]*v1.Service)}
+	for _, svc := range services {
+		f.services[svc.Namespace+"/"+svc.Name] = svc.DeepCopy()
+	}
+	return f
+}
+
+// Cache returns the cache sharing the services with the client.
+func (f *ServiceClient) Cache() *ServiceCache {
+	return (*ServiceCache)(f)
+}
+
+func (f *ServiceClient) Create(svc *v1.Service) (*v1.Service, error) {
+	key := svc.Namespace + "/" + svc.Name
+	if _, ok := f.services[key]; ok {
+		return nil, apierrors.NewAlreadyExists(serviceResource, svc.Name)
+	}
+	f.services[key] = svc.DeepCopy()
+	return svc.DeepCopy(), nil
+}
+
+// Update rejects the service with a stale resource version like the API server does, the resource version is ignored
+// if it is empty.
+func (f *ServiceClient) Update(svc *v1.Service) (*v1.Service, error) {
+	key := svc.Namespace + "/" + svc.Name
+	stored, ok := f.services[key]
+	if !ok {
+		return nil, apierrors.NewNotFound(serviceResource, svc.Name)
+	}
+	if svc.ResourceVersion != "" && svc.ResourceVersion != stored.ResourceVersion {
+		return nil, apierrors.NewConflict(serviceResource, svc.Name, fmt.Errorf("the object has been modified"))
+	}
+	version, _ := strconv.Atoi(stored.ResourceVersion)
+	updated := svc.DeepCopy()
+	updated.ResourceVersion = strconv.Itoa(version + 1)
+	f.services[key] = updated
+	return updated.DeepCopy(), nil
+}
+
+func (f *ServiceClient) UpdateStatus(svc *v1.Service) (*v1.Service, error) {
+	return f.Update(svc)
+}
+
+func (f *ServiceClient) Delete(namespace, name string, _ *metav1.DeleteOptions) error {
+	key := namespace + "/" + name
+	if _, ok := f.services[key]; !ok {
+		return apierrors.NewNotFound(serviceResource, name)
+	}
+	delete(f.services, key)
+	return nil
+}
+
+func (f *ServiceClient) Get(namespace, name string, _ metav1.GetOptions) (*v1.Service, error) {
+	return f.Cache().Get(namespace, name)
+}
+
+func (f *ServiceClient) List(namespace string, _ metav1.ListOptions) (*v1.ServiceList, error) {
+	svcs, _ := f.Cache().List(namespace, labels.Everything())
+	list := &v1.ServiceList{}
+	for _, svc := range svcs {
+		list.Items = append(list.Items, *svc)
+	}
+	return list, nil
+}
+
+func (f *ServiceClient) Watch(_ string, _ metav1.ListOptions) (watch.Interface, error) {
+	return nil, fmt.Errorf("watch is not supported by the fake client")
+}
+
+func (f *ServiceClient) Patch(_, _ string, _ types.PatchType, _ []byte, _ ...string) (*v1.Service, error) {
+	return nil, fmt.Errorf("patch is not supported by the fake client")
+}
+
+func (f *ServiceClient) WithImpersonation(_ rest.ImpersonationConfig) (generic.ClientInterface[*v1.Service, *v1.ServiceList], error) {
+	return f, nil
+}
+
+func (f *ServiceCache) Get(namespace, name string) (*v1.Service, error) {
+	svc, ok := f.services[namespace+"/"+name]
+	if !ok {
+		return nil, apierrors.NewNotFound(serviceResource, name)
+	}
+	return svc.DeepCopy(), nil
+}
+
+func (f *ServiceCache) List(namespace string, selector labels.Selector) ([]*v1.Service, error) {
+	var svcs []*v1.Service
+	for _, svc := range f.services {
+		if (namespace == metav1.NamespaceAll || svc.Namespace == namespace) && selector.Matches(labels.Set(svc.Labels)) {
+			svcs = append(svcs, svc.DeepCopy())
+		}
+	}
+	return svcs, nil
+}
+
+func (f *ServiceCache) AddIndexer(_ string, _ generic.Indexer[*v1.Service]) {}
+
+func (f *ServiceCache) GetByIndex(_, _ string) ([]*v1.Service, error) {
+	return nil, nil
+}
@@ -0,0 +1,147 @@
+package fakeclients
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/rancher/wrangler/v3/pkg/generic"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/rest"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+var virtualMachineResource = kubevirtv1.SchemeGroupVersion.WithResource("virtualmachines").GroupResource()
+
+// VirtualMachineClient is a minimal in-memory VirtualMachineClient for use in unit tests. Its Cache reads the same
+// VirtualMachines.
+type VirtualMachineClient struct {
+	objs     map[string]*kubevirtv1.VirtualMachine
+	indexers map[string]generic.Indexer[*kubevirtv1.VirtualMachine]
+}
+
+// VirtualMachineCache is the VirtualMachineCache view of a VirtualMachineClient, it supports the indexers.
+type VirtualMachineCache VirtualMachineClient
+
+// NewVirtualMachineClient returns a VirtualMachineClient storing the given VirtualMachines.
+func NewVirtualMachineClient(objs ...*kubevirtv1.VirtualMachine) *VirtualMachineClient {
+	f := &VirtualMachineClient{
+		objs:     make(map[string]*kubevirtv1.VirtualMachine),
+		indexers: make(map[string]generic.Indexer[*kubevirtv1.VirtualMachine]),
+	}
+	for _, obj := range objs {
+		f.objs[obj.Namespace+"/"+obj.Name] = obj.DeepCopy()
+	}
+	return f
+}
+
+// Cache returns the cache sharing the VirtualMachines with the client.
+func (f *VirtualMachineClient) Cache() *VirtualMachineCache {
+	return (*VirtualMachineCache)(f)
+}
+
+func (f *VirtualMachineClient) Create(obj *kubevirtv1.VirtualMachine) (*kubevirtv1.VirtualMachine, error) {
+	key := obj.Namespace + "/" + obj.Name
+	if _, ok := f.objs[key]; ok {
+		return nil, apierrors.NewAlreadyExists(virtualMachineResource, obj.Name)
+	}
+	f.objs[key] = obj.DeepCopy()
+	return obj.DeepCopy(), nil
+}
+
+func (f *VirtualMachineClient) Update(obj *kubevirtv1.VirtualMachine) (*kubevirtv1.VirtualMachine, error) {
+	key := obj.Namespace + "/" + obj.Name
+	if _, ok := f.objs[key]; !ok {
+		return nil, apierrors.NewNotFound(virtualMachineResource, obj.Name)
+	}
+	f.objs[key] = obj.DeepCopy()
+	return obj.DeepCopy(), nil
+}
+
+func (f *VirtualMachineClient) UpdateStatus(obj *kubevirtv1.VirtualMachine) (*kubevirtv1.VirtualMachine, error) {
+	return f.Update(obj)
+}
+
+func (f *VirtualMachineClient) Delete(namespace, name string, _ *metav1.DeleteOptions) error {
+	key := namespace + "/" + name
+	if _, ok := f.objs[key]; !ok {
+		return apierrors.NewNotFound(virtualMachineResource, name)
+	}
+	delete(f.objs, key)
+	return nil
+}
+
+func (f *VirtualMachineClient) Get(namespace, name string, _ metav1.GetOptions) (*kubevirtv1.VirtualMachine, error) {
+	obj, ok := f.objs[namespace+"/"+name]
+	if !ok {
+		return nil, apierrors.NewNotFound(virtualMachineResource, name)
+	}
+	return obj.DeepCopy(), nil
+}
+
+// List supports the label selector of the options.
+func (f *VirtualMachineClient) List(namespace string, opts metav1.ListOptions) (*kubevirtv1.VirtualMachineList, error) {
+	selector, err := labels.Parse(opts.LabelSelector)
+	if err != nil {
+		return nil, err
+	}
+	list := &kubevirtv1.VirtualMachineList{}
+	for _, obj := range f.objs {
+		if (namespace == metav1.NamespaceAll || obj.Namespace == namespace) && selector.Matches(labels.Set(obj.Labels)) {
+			list.Items = append(list.Items, *obj.DeepCopy())
+		}
+	}
+	return list, nil
+}
+
+func (f *VirtualMachineClient) Watch(_ string, _ metav1.ListOptions) (watch.Interface, error) {
+	return nil, fmt.Errorf("watch is not supported by the fake client")
+}
+
+func (f *VirtualMachineClient) Patch(_, _ string, _ types.PatchType, _ []byte, _ ...string) (*kubevirtv1.VirtualMachine, error) {
+	return nil, fmt.Errorf("patch is not supported by the fake client")
+}
+
+func (f *VirtualMachineClient) WithImpersonation(_ rest.ImpersonationConfig) (generic.ClientInterface[*kubevirtv1.VirtualMachine, *kubevirtv1.VirtualMachineList], error) {
+	return f, nil
+}
+
+func (f *VirtualMachineCache) Get(namespace, name string) (*kubevirtv1.VirtualMachine, error) {
+	return (*VirtualMachineClient)(f).Get(namespace, name, metav1.GetOptions{})
+}
+
+func (f *VirtualMachineCache) List(namespace string, selector labels.Selector) ([]*kubevirtv1.VirtualMachine, error) {
+	var vms []*kubevirtv1.VirtualMachine
+	for _, obj := range f.objs {
+		if (namespace == metav1.NamespaceAll || obj.Namespace == namespace) && selector.Matches(labels.Set(obj.Labels)) {
+			vms = append(vms, obj.DeepCopy())
+		}
+	}
+	return vms, nil
+}
+
+func (f *VirtualMachineCache) AddIndexer(indexName string, indexer generic.Indexer[*kubevirtv1.VirtualMachine]) {
+	f.indexers[indexName] = indexer
+}
+
+// GetByIndex runs the indexer on all the objects, an unknown index returns an error like the informer.
+func (f *VirtualMachineCache) GetByIndex(indexName, key string) ([]*kubevirtv1.VirtualMachine, error) {
+	indexer, ok := f.indexers[indexName]
+	if !ok {
+		return nil, fmt.Errorf("index with name %s does not exist", indexName)
+	}
+	var vms []*kubevirtv1.VirtualMachine
+	for _, obj := range f.objs {
+		keys, err := indexer(obj)
+		if err != nil {
+			return nil, err
+		}
+		if slices.Contains(keys, key) {
+			vms = append(vms, obj.DeepCopy())
+		}
+	}
+	return vms, nil
+}
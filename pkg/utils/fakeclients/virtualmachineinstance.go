@@ -0,0 +1,96 @@
+package fakeclients
+
+import (
+	"fmt"
+
+	"github.com/rancher/wrangler/v3/pkg/generic"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/rest"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+var virtualMachineInstanceResource = kubevirtv1.SchemeGroupVersion.WithResource("virtualmachineinstances").GroupResource()
+
+// VirtualMachineInstanceClient is a minimal in-memory VirtualMachineInstanceClient for use in unit tests.
+type VirtualMachineInstanceClient struct {
+	objs map[string]*kubevirtv1.VirtualMachineInstance
+}
+
+// NewVirtualMachineInstanceClient returns a VirtualMachineInstanceClient storing the given VirtualMachineInstances.
+func NewVirtualMachineInstanceClient(objs ...*kubevirtv1.VirtualMachineInstance) *VirtualMachineInstanceClient {
+	f := &VirtualMachineInstanceClient{objs: make(map[string]*kubevirtv1.VirtualMachineInstance)}
+	for _, obj := range objs {
+		f.objs[obj.Namespace+"/"+obj.Name] = obj.DeepCopy()
+	}
+	return f
+}
+
+func (f *VirtualMachineInstanceClient) Create(obj *kubevirtv1.VirtualMachineInstance) (*kubevirtv1.VirtualMachineInstance, error) {
+	key := obj.Namespace + "/" + obj.Name
+	if _, ok := f.objs[key]; ok {
+		return nil, apierrors.NewAlreadyExists(virtualMachineInstanceResource, obj.Name)
+	}
+	f.objs[key] = obj.DeepCopy()
+	return obj.DeepCopy(), nil
+}
+
+func (f *VirtualMachineInstanceClient) Update(obj *kubevirtv1.VirtualMachineInstance) (*kubevirtv1.VirtualMachineInstance, error) {
+	key := obj.Namespace + "/" + obj.Name
+	if _, ok := f.objs[key]; !ok {
+		return nil, apierrors.NewNotFound(virtualMachineInstanceResource, obj.Name)
+	}
+	f.objs[key] = obj.DeepCopy()
+	return obj.DeepCopy(), nil
+}
+
+func (f *VirtualMachineInstanceClient) UpdateStatus(obj *kubevirtv1.VirtualMachineInstance) (*kubevirtv1.VirtualMachineInstance, error) {
+	return f.Update(obj)
+}
+
+func (f *VirtualMachineInstanceClient) Delete(namespace, name string, _ *metav1.DeleteOptions) error {
+	key := namespace + "/" + name
+	if _, ok := f.objs[key]; !ok {
+		return apierrors.NewNotFound(virtualMachineInstanceResource, name)
+	}
+	delete(f.objs, key)
+	return nil
+}
+
+func (f *VirtualMachineInstanceClient) Get(namespace, name string, _ metav1.GetOptions) (*kubevirtv1.VirtualMachineInstance, error) {
+	obj, ok := f.objs[namespace+"/"+name]
+	if !ok {
+		return nil, apierrors.NewNotFound(virtualMachineInstanceResource, name)
+	}
+	return obj.DeepCopy(), nil
+}
+
+// List supports the label selector of the options.
+func (f *VirtualMachineInstanceClient) List(namespace string, opts metav1.ListOptions) (*kubevirtv1.VirtualMachineInstanceList, error) {
+	selector, err := labels.Parse(opts.LabelSelector)
+	if err != nil {
+		return nil, err
+	}
+	list := &kubevirtv1.VirtualMachineInstanceList{}
+	for _, obj := range f.objs {
+		if (namespace == metav1.NamespaceAll || obj.Namespace == namespace) && selector.Matches(labels.Set(obj.Labels)) {
+			list.Items = append(list.Items, *obj.DeepCopy())
+		}
+	}
+	return list, nil
+}
+
+func (f *VirtualMachineInstanceClient) Watch(_ string, _ metav1.ListOptions) (watch.Interface, error) {
+	return nil, fmt.Errorf("watch is not supported by the fake client")
+}
+
+func (f *VirtualMachineInstanceClient) Patch(_, _ string, _ types.PatchType, _ []byte, _ ...string) (*kubevirtv1.VirtualMachineInstance, error) {
+	return nil, fmt.Errorf("patch is not supported by the fake client")
+}
+
+func (f *VirtualMachineInstanceClient) WithImpersonation(_ rest.ImpersonationConfig) (generic.ClientInterface[*kubevirtv1.VirtualMachineInstance, *kubevirtv1.VirtualMachineInstanceList], error) {
+	return f, nil
+}
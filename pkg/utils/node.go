@@ -0,0 +1,28 @@
+package utils
+
+import (
+	ctlcorev1 "github.com/rancher/wrangler/v3/pkg/generated/controllers/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+// RecordVMNameOnNode annotates the guest node with the name of its VM by AnnotationKeyVMNameOnNode, it's a no-op if the
+// annotation is up-to-date.
+func RecordVMNameOnNode(nodeClient ctlcorev1.NodeClient, nodeName, vmName string) error {
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		node, err := nodeClient.Get(nodeName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if node.Annotations[AnnotationKeyVMNameOnNode] == vmName {
+			return nil
+		}
+		nodeCopy := node.DeepCopy()
+		if nodeCopy.Annotations == nil {
+			nodeCopy.Annotations = make(map[string]string)
+		}
+		nodeCopy.Annotations[AnnotationKeyVMNameOnNode] = vmName
+		_, err = nodeClient.Update(nodeCopy)
+		return err
+	})
+}